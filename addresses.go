@@ -0,0 +1,204 @@
+package libplumraw
+
+// addresses.go remembers where lightpads were last heard from across restarts,
+// so a controller can reach them without waiting for their next heartbeat.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AddressCacheVersion is the version of the address cache file format
+const AddressCacheVersion = 1
+
+// DefaultAddressCacheSaveInterval is how often Run saves the cache when no
+// lightpad has moved, to keep LastSeen fresh
+const DefaultAddressCacheSaveInterval = 5 * time.Minute
+
+// AddressEntry is what an AddressCache knows about one lightpad
+type AddressEntry struct {
+	LPID     string    `json:"lpid"`
+	LLID     string    `json:"llid,omitempty"`
+	HAT      string    `json:"hat,omitempty"`
+	IP       net.IP    `json:"ip,omitempty"`
+	Port     int       `json:"port,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type addressFile struct {
+	Version   int            `json:"version"`
+	Lightpads []AddressEntry `json:"lightpads"`
+}
+
+// AddressCache keeps the last known address of each lightpad in a file. The
+// file includes house access tokens, so treat it as a secret.
+type AddressCache struct {
+	// OnError, if set, is called when Run fails to save the cache. Run
+	// carries on and tries again after the next heartbeat.
+	OnError func(error)
+	// SaveInterval is how long Run goes between saves while lightpads keep
+	// their addresses. Zero means DefaultAddressCacheSaveInterval.
+	SaveInterval time.Duration
+
+	filename string
+
+	mu      sync.Mutex
+	entries map[string]AddressEntry
+
+	// saveMu keeps saves in order, so an older snapshot can't replace a
+	// newer one
+	saveMu sync.Mutex
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// OpenAddressCache loads the cache saved in filename. A file that doesn't
+// exist yet gives an empty cache which will be created by Save.
+func OpenAddressCache(filename string) (*AddressCache, error) {
+	c := &AddressCache{
+		filename: filename,
+		entries:  make(map[string]AddressEntry),
+		now:      time.Now,
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	af := addressFile{}
+	if err := json.NewDecoder(f).Decode(&af); err != nil {
+		return nil, fmt.Errorf("reading address cache %s: %w", filename, err)
+	}
+	if af.Version < 1 || af.Version > AddressCacheVersion {
+		return nil, fmt.Errorf("unsupported address cache version %d", af.Version)
+	}
+	for _, e := range af.Lightpads {
+		c.entries[e.LPID] = e
+	}
+	return c, nil
+}
+
+// Save writes the cache to its file, replacing it atomically
+func (c *AddressCache) Save() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	af := addressFile{
+		Version:   AddressCacheVersion,
+		Lightpads: c.All(),
+	}
+	return writeFileAtomic(c.filename, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(af)
+	})
+}
+
+// Observe records a heartbeat from a lightpad. It reports whether the
+// lightpad is new or its address changed.
+func (c *AddressCache) Observe(la LightpadAnnouncement) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[la.ID]
+	changed := !ok || !e.IP.Equal(la.IP) || e.Port != la.Port
+	e.LPID = la.ID
+	e.IP = la.IP
+	e.Port = la.Port
+	e.LastSeen = c.now().UTC()
+	c.entries[la.ID] = e
+	return changed
+}
+
+// Associate records the logical load a lightpad controls and the access token
+// of its house, as found from the Plum web service
+func (c *AddressCache) Associate(lpid, llid, hat string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[lpid]
+	e.LPID = lpid
+	e.LLID = llid
+	e.HAT = hat
+	c.entries[lpid] = e
+}
+
+// Forget drops the lightpad from the cache
+func (c *AddressCache) Forget(lpid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, lpid)
+}
+
+// Lookup returns what is known about the lightpad
+func (c *AddressCache) Lookup(lpid string) (AddressEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[lpid]
+	return e, ok
+}
+
+// All returns every lightpad in the cache, sorted by LPID
+func (c *AddressCache) All() []AddressEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	all := make([]AddressEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		all = append(all, e)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].LPID < all[j].LPID })
+	return all
+}
+
+// Announcements returns an announcement for each lightpad in the cache whose
+// address is known, sorted by LPID. Pass them to LightpadFactory.Observe or
+// Registry.Observe to use the addresses saved before a restart without
+// waiting for heartbeats.
+func (c *AddressCache) Announcements() []LightpadAnnouncement {
+	var las []LightpadAnnouncement
+	for _, e := range c.All() {
+		if e.IP == nil || e.Port == 0 {
+			continue
+		}
+		las = append(las, LightpadAnnouncement{ID: e.LPID, IP: e.IP, Port: e.Port})
+	}
+	return las
+}
+
+// Run listens for heartbeats until the context is done, recording each one.
+// The cache is saved when a lightpad is new or has moved, and otherwise at
+// most once every SaveInterval. It returns an error if the listener can't be
+// started, otherwise the result of a final Save, which keeps every LastSeen,
+// once the context is done.
+func (c *AddressCache) Run(ctx context.Context, hl HeartbeatListener) error {
+	announcements, err := hl.Listen(ctx)
+	if err != nil {
+		return err
+	}
+	interval := c.SaveInterval
+	if interval == 0 {
+		interval = DefaultAddressCacheSaveInterval
+	}
+	var saved time.Time
+	for la := range announcements {
+		if !c.Observe(la) && c.now().Sub(saved) < interval {
+			continue
+		}
+		if err := c.Save(); err != nil {
+			if c.OnError != nil {
+				c.OnError(err)
+			}
+			continue
+		}
+		saved = c.now()
+	}
+	return c.Save()
+}
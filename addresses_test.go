@@ -0,0 +1,181 @@
+package libplumraw
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libplumraw")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "addresses.json")
+
+	// a cache that hasn't been saved yet starts empty
+	c, err := OpenAddressCache(filename)
+	assert.NoError(t, err)
+	assert.Empty(t, c.All())
+	clock := newFakeClock()
+	c.now = clock.now
+
+	la := LightpadAnnouncement{ID: "pad2", IP: net.ParseIP("10.0.0.2"), Port: 8443}
+	assert.True(t, c.Observe(la))
+	assert.False(t, c.Observe(la))
+	la.IP = net.ParseIP("10.0.0.3")
+	assert.True(t, c.Observe(la))
+	c.Associate("pad2", "load1", "hat")
+	c.Associate("pad1", "load1", "hat")
+	assert.NoError(t, c.Save())
+
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	c, err = OpenAddressCache(filename)
+	assert.NoError(t, err)
+	all := c.All()
+	assert.Len(t, all, 2)
+	// pad1 is known from the web service but hasn't been heard from
+	assert.Equal(t, AddressEntry{LPID: "pad1", LLID: "load1", HAT: "hat"}, all[0])
+	e, ok := c.Lookup("pad2")
+	assert.True(t, ok)
+	assert.Equal(t, "load1", e.LLID)
+	assert.Equal(t, "hat", e.HAT)
+	assert.True(t, e.IP.Equal(net.ParseIP("10.0.0.3")))
+	assert.Equal(t, 8443, e.Port)
+	assert.True(t, clock.now().Equal(e.LastSeen))
+
+	// only lightpads that have been heard from can be announced
+	assert.Equal(t, []LightpadAnnouncement{{ID: "pad2", IP: e.IP, Port: 8443}}, c.Announcements())
+	// which is enough to get going with straight after a restart
+	f, _ := NewLightpadFactory(context.Background(), newMapWebConnection(), "house1")
+	for _, la := range c.Announcements() {
+		f.Observe(la)
+	}
+	lp, ok := f.Lightpad("pad2")
+	assert.True(t, ok)
+	assert.True(t, lp.IP.Equal(net.ParseIP("10.0.0.3")))
+
+	c.Forget("pad1")
+	_, ok = c.Lookup("pad1")
+	assert.False(t, ok)
+}
+
+func TestAddressCacheErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libplumraw")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, contents := range map[string]string{
+		"garbage.json": "not json",
+		"future.json":  `{"version": 99, "lightpads": []}`,
+	} {
+		filename := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0600))
+		_, err := OpenAddressCache(filename)
+		assert.Error(t, err, name)
+	}
+}
+
+// waitForFile waits for the file to exist, reporting whether it does
+func waitForFile(filename string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(filename); err == nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAddressCacheRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libplumraw")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "addresses.json")
+
+	c, err := OpenAddressCache(filename)
+	assert.NoError(t, err)
+	// Run reads the time while the test moves it on
+	start := time.Unix(1500000000, 0)
+	var elapsed int64
+	now := func() time.Time { return start.Add(time.Duration(atomic.LoadInt64(&elapsed))) }
+	c.now = now
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	hb := &TestLightpadHeartbeat{
+		LightpadAnnouncement: LightpadAnnouncement{ID: "pad1", IP: net.ParseIP("10.0.0.2"), Port: 8443},
+		Interval:             time.Millisecond,
+	}
+	go func() { done <- c.Run(ctx, hb) }()
+	// a new lightpad is saved straight away
+	assert.True(t, waitForFile(filename, time.Second))
+
+	// heartbeats from where it was aren't saved until the interval is up
+	assert.NoError(t, os.Remove(filename))
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, waitForFile(filename, 0))
+	atomic.AddInt64(&elapsed, int64(DefaultAddressCacheSaveInterval))
+	assert.True(t, waitForFile(filename, time.Second))
+
+	// stopping saves when it was last seen
+	assert.NoError(t, os.Remove(filename))
+	atomic.AddInt64(&elapsed, int64(time.Minute))
+	assert.Eventually(t, func() bool {
+		e, _ := c.Lookup("pad1")
+		return now().Equal(e.LastSeen)
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+
+	// what was heard is there after a restart
+	c, err = OpenAddressCache(filename)
+	assert.NoError(t, err)
+	e, ok := c.Lookup("pad1")
+	assert.True(t, ok)
+	assert.Equal(t, 8443, e.Port)
+	assert.True(t, now().Equal(e.LastSeen))
+
+	// a listener that fails is reported
+	hbErr := errors.New("port in use")
+	hb.Error = &hbErr
+	assert.Equal(t, hbErr, c.Run(context.Background(), hb))
+}
+
+func TestAddressCacheConcurrentSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libplumraw")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "addresses.json")
+
+	c, err := OpenAddressCache(filename)
+	assert.NoError(t, err)
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			c.Observe(LightpadAnnouncement{ID: "pad1", IP: net.ParseIP("10.0.0.2"), Port: 8000 + i})
+			errs <- c.Save()
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, <-errs)
+	}
+	// whichever save came last wrote the cache as it is now
+	want, _ := c.Lookup("pad1")
+	c, err = OpenAddressCache(filename)
+	assert.NoError(t, err)
+	got, _ := c.Lookup("pad1")
+	assert.Equal(t, want.Port, got.Port)
+}
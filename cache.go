@@ -0,0 +1,420 @@
+package libplumraw
+
+// cache.go has a WebConnection that remembers what another WebConnection
+// returned so that repeated calls don't all go out to the Plum web service.
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheTTL is how long a CachingWebConnection keeps an object when
+	// its CacheConfig doesn't say
+	DefaultCacheTTL = 5 * time.Minute
+	// DefaultCacheRefreshTimeout bounds background refreshes when the
+	// CacheConfig doesn't say
+	DefaultCacheRefreshTimeout = 30 * time.Second
+)
+
+// CacheConfig sets how long a CachingWebConnection keeps each kind of object.
+// A zero TTL means DefaultCacheTTL; a negative TTL turns off caching for that
+// kind of object.
+type CacheConfig struct {
+	// HouseTTL covers both the list of houses and each house
+	HouseTTL time.Duration
+	RoomTTL  time.Duration
+	// LogicalLoadTTL covers logical loads
+	LogicalLoadTTL time.Duration
+	// LightpadTTL covers lightpad specs
+	LightpadTTL time.Duration
+	// SceneTTL covers both the list of scenes in a house and each scene
+	SceneTTL time.Duration
+	// StaleWhileRevalidate is how long after its TTL an object is still
+	// returned from the cache. When a stale object is returned it is fetched
+	// again in the background. Zero means expired objects are always fetched
+	// before returning.
+	StaleWhileRevalidate time.Duration
+	// RefreshTimeout bounds each background refresh. Zero means
+	// DefaultCacheRefreshTimeout.
+	RefreshTimeout time.Duration
+}
+
+// CacheStats counts how calls to a CachingWebConnection were answered
+type CacheStats struct {
+	// Hits were answered from the cache with an object within its TTL
+	Hits uint64
+	// StaleHits were answered from the cache with an object past its TTL
+	// (but within StaleWhileRevalidate) and started a background refresh
+	StaleHits uint64
+	// Misses had to wait for the wrapped WebConnection, including those that
+	// shared a call already in flight for the same object
+	Misses uint64
+	// RefreshErrors counts background refreshes that failed. The stale object
+	// stays in the cache until it is no longer fresh enough to return.
+	RefreshErrors uint64
+}
+
+// CachingWebConnection implements WebConnection by wrapping another
+// WebConnection and caching what it returns by ID. Concurrent misses for the
+// same object share one call to the wrapped connection. Scene changes and
+// renames are passed straight through and drop the affected objects from the
+// cache.
+//
+// Objects returned share memory with the cache; don't modify them (including
+// their ID lists).
+type CachingWebConnection struct {
+	wc   WebConnection
+	conf CacheConfig
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	calls   map[cacheKey]*cacheCall
+	stats   CacheStats
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+type cacheKind int
+
+const (
+	cacheHouses cacheKind = iota
+	cacheHouse
+	cacheScenes
+	cacheScene
+	cacheRoom
+	cacheLogicalLoad
+	cacheLightpad
+)
+
+type cacheKey struct {
+	kind cacheKind
+	id   string
+}
+
+type cacheEntry struct {
+	value      interface{}
+	expires    time.Time
+	refreshing bool
+}
+
+// cacheCall is a fetch in flight for a missing entry, shared by every caller
+// that misses on the key until it finishes
+type cacheCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+	// invalidated is set if the key is invalidated during the fetch, so the
+	// result, fetched before the invalidation, isn't stored
+	invalidated bool
+}
+
+// NewCachingWebConnection returns a CachingWebConnection that fetches anything
+// it doesn't have from wc
+func NewCachingWebConnection(wc WebConnection, conf CacheConfig) *CachingWebConnection {
+	return &CachingWebConnection{
+		wc:      wc,
+		conf:    conf,
+		entries: make(map[cacheKey]*cacheEntry),
+		calls:   make(map[cacheKey]*cacheCall),
+		now:     time.Now,
+	}
+}
+
+func (c *CachingWebConnection) GetHouses(ctx context.Context) (Houses, error) {
+	v, err := c.get(ctx, cacheKey{cacheHouses, ""}, func(ctx context.Context) (interface{}, error) {
+		return c.wc.GetHouses(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(Houses), nil
+}
+
+func (c *CachingWebConnection) GetHouse(ctx context.Context, hid string) (House, error) {
+	v, err := c.get(ctx, cacheKey{cacheHouse, hid}, func(ctx context.Context) (interface{}, error) {
+		return c.wc.GetHouse(ctx, hid)
+	})
+	if err != nil {
+		return House{}, err
+	}
+	return v.(House), nil
+}
+
+func (c *CachingWebConnection) GetScenes(ctx context.Context, hid string) (Scenes, error) {
+	v, err := c.get(ctx, cacheKey{cacheScenes, hid}, func(ctx context.Context) (interface{}, error) {
+		return c.wc.GetScenes(ctx, hid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(Scenes), nil
+}
+
+func (c *CachingWebConnection) GetScene(ctx context.Context, sid string) (Scene, error) {
+	v, err := c.get(ctx, cacheKey{cacheScene, sid}, func(ctx context.Context) (interface{}, error) {
+		return c.wc.GetScene(ctx, sid)
+	})
+	if err != nil {
+		return Scene{}, err
+	}
+	return v.(Scene), nil
+}
+
+func (c *CachingWebConnection) GetRoom(ctx context.Context, rid string) (Room, error) {
+	v, err := c.get(ctx, cacheKey{cacheRoom, rid}, func(ctx context.Context) (interface{}, error) {
+		return c.wc.GetRoom(ctx, rid)
+	})
+	if err != nil {
+		return Room{}, err
+	}
+	return v.(Room), nil
+}
+
+func (c *CachingWebConnection) GetLogicalLoad(ctx context.Context, llid string) (LogicalLoad, error) {
+	v, err := c.get(ctx, cacheKey{cacheLogicalLoad, llid}, func(ctx context.Context) (interface{}, error) {
+		return c.wc.GetLogicalLoad(ctx, llid)
+	})
+	if err != nil {
+		return LogicalLoad{}, err
+	}
+	return v.(LogicalLoad), nil
+}
+
+func (c *CachingWebConnection) GetLightpad(ctx context.Context, lpid string) (LightpadSpec, error) {
+	v, err := c.get(ctx, cacheKey{cacheLightpad, lpid}, func(ctx context.Context) (interface{}, error) {
+		return c.wc.GetLightpad(ctx, lpid)
+	})
+	if err != nil {
+		return LightpadSpec{}, err
+	}
+	return v.(LightpadSpec), nil
+}
+
+func (c *CachingWebConnection) CreateScene(ctx context.Context, scene Scene) (Scene, error) {
+	created, err := c.wc.CreateScene(ctx, scene)
+	c.invalidate(cacheKey{cacheScenes, scene.HouseID})
+	return created, err
+}
+
+func (c *CachingWebConnection) UpdateScene(ctx context.Context, scene Scene) error {
+	err := c.wc.UpdateScene(ctx, scene)
+	c.InvalidateScene(scene.ID)
+	return err
+}
+
+func (c *CachingWebConnection) DeleteScene(ctx context.Context, sid string) error {
+	err := c.wc.DeleteScene(ctx, sid)
+	c.InvalidateScene(sid)
+	return err
+}
+
+func (c *CachingWebConnection) RenameRoom(ctx context.Context, rid, name string) error {
+	err := c.wc.RenameRoom(ctx, rid, name)
+	c.InvalidateRoom(rid)
+	return err
+}
+
+func (c *CachingWebConnection) RenameLogicalLoad(ctx context.Context, llid, name string) error {
+	err := c.wc.RenameLogicalLoad(ctx, llid, name)
+	c.InvalidateLogicalLoad(llid)
+	return err
+}
+
+func (c *CachingWebConnection) RenameLightpad(ctx context.Context, lpid, name string) error {
+	err := c.wc.RenameLightpad(ctx, lpid, name)
+	c.InvalidateLightpad(lpid)
+	return err
+}
+
+// InvalidateHouse drops the house and the list of houses from the cache
+func (c *CachingWebConnection) InvalidateHouse(hid string) {
+	c.invalidate(cacheKey{cacheHouse, hid}, cacheKey{cacheHouses, ""})
+}
+
+// InvalidateScene drops the scene from the cache, along with every house's
+// list of scenes
+func (c *CachingWebConnection) InvalidateScene(sid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drop(cacheKey{cacheScene, sid})
+	for key := range c.entries {
+		if key.kind == cacheScenes {
+			c.drop(key)
+		}
+	}
+	for key := range c.calls {
+		if key.kind == cacheScenes {
+			c.drop(key)
+		}
+	}
+}
+
+// InvalidateRoom drops the room from the cache
+func (c *CachingWebConnection) InvalidateRoom(rid string) {
+	c.invalidate(cacheKey{cacheRoom, rid})
+}
+
+// InvalidateLogicalLoad drops the logical load from the cache
+func (c *CachingWebConnection) InvalidateLogicalLoad(llid string) {
+	c.invalidate(cacheKey{cacheLogicalLoad, llid})
+}
+
+// InvalidateLightpad drops the lightpad spec from the cache
+func (c *CachingWebConnection) InvalidateLightpad(lpid string) {
+	c.invalidate(cacheKey{cacheLightpad, lpid})
+}
+
+// InvalidateAll empties the cache
+func (c *CachingWebConnection) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, call := range c.calls {
+		call.invalidated = true
+	}
+	c.entries = make(map[cacheKey]*cacheEntry)
+	c.calls = make(map[cacheKey]*cacheCall)
+}
+
+// Stats returns counts of how calls have been answered so far
+func (c *CachingWebConnection) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *CachingWebConnection) invalidate(keys ...cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		c.drop(key)
+	}
+}
+
+// drop removes the key from the cache and stops any fetch in flight for it
+// from being stored. c.mu must be held.
+func (c *CachingWebConnection) drop(key cacheKey) {
+	delete(c.entries, key)
+	if call, ok := c.calls[key]; ok {
+		call.invalidated = true
+		delete(c.calls, key)
+	}
+}
+
+func (c *CachingWebConnection) ttl(kind cacheKind) time.Duration {
+	var ttl time.Duration
+	switch kind {
+	case cacheHouses, cacheHouse:
+		ttl = c.conf.HouseTTL
+	case cacheScenes, cacheScene:
+		ttl = c.conf.SceneTTL
+	case cacheRoom:
+		ttl = c.conf.RoomTTL
+	case cacheLogicalLoad:
+		ttl = c.conf.LogicalLoadTTL
+	case cacheLightpad:
+		ttl = c.conf.LightpadTTL
+	}
+	if ttl == 0 {
+		ttl = DefaultCacheTTL
+	}
+	return ttl
+}
+
+// get returns the cached value for key if it is fresh enough, otherwise the
+// value from fetch. Stale values within StaleWhileRevalidate are returned
+// right away and refreshed in the background. Callers that miss while a fetch
+// for the key is in flight wait for it rather than fetching again.
+func (c *CachingWebConnection) get(ctx context.Context, key cacheKey, fetch func(context.Context) (interface{}, error)) (interface{}, error) {
+	ttl := c.ttl(key.kind)
+	if ttl < 0 {
+		return fetch(ctx)
+	}
+	// a caller that waits on another's fetch and has to try again is still
+	// only one miss
+	missed := false
+	for {
+		c.mu.Lock()
+		now := c.now()
+		if e, ok := c.entries[key]; ok {
+			if now.Before(e.expires) {
+				if !missed {
+					c.stats.Hits++
+				}
+				c.mu.Unlock()
+				return e.value, nil
+			}
+			if now.Before(e.expires.Add(c.conf.StaleWhileRevalidate)) {
+				if !missed {
+					c.stats.StaleHits++
+				}
+				if !e.refreshing {
+					e.refreshing = true
+					go c.refresh(key, e, fetch)
+				}
+				c.mu.Unlock()
+				return e.value, nil
+			}
+		}
+		if !missed {
+			c.stats.Misses++
+			missed = true
+		}
+		call, ok := c.calls[key]
+		if !ok {
+			call = &cacheCall{done: make(chan struct{})}
+			c.calls[key] = call
+			c.mu.Unlock()
+			call.value, call.err = fetch(ctx)
+
+			c.mu.Lock()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+			if call.err == nil && !call.invalidated {
+				c.entries[key] = &cacheEntry{value: call.value, expires: c.now().Add(ttl)}
+			}
+			c.mu.Unlock()
+			close(call.done)
+			return call.value, call.err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// the caller making the call gave up; it's no reason for this one to
+		if errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded) {
+			continue
+		}
+		return call.value, call.err
+	}
+}
+
+// refresh fetches a stale entry again. The result is only stored if the entry
+// hasn't been invalidated or replaced in the meantime.
+func (c *CachingWebConnection) refresh(key cacheKey, e *cacheEntry, fetch func(context.Context) (interface{}, error)) {
+	timeout := c.conf.RefreshTimeout
+	if timeout == 0 {
+		timeout = DefaultCacheRefreshTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	v, err := fetch(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refreshing = false
+	if err != nil {
+		c.stats.RefreshErrors++
+		return
+	}
+	if c.entries[key] == e {
+		c.entries[key] = &cacheEntry{value: v, expires: c.now().Add(c.ttl(key.kind))}
+	}
+}
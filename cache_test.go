@@ -0,0 +1,260 @@
+package libplumraw
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock lets tests move a CachingWebConnection through time
+type fakeClock struct {
+	t time.Time
+}
+
+func (f *fakeClock) now() time.Time                   { return f.t }
+func (f *fakeClock) advance(d time.Duration)          { f.t = f.t.Add(d) }
+func newFakeClock() *fakeClock                        { return &fakeClock{time.Unix(1500000000, 0)} }
+func (c *CachingWebConnection) setClock(f *fakeClock) { c.now = f.now }
+
+func TestCachingWebConnection(t *testing.T) {
+	ctx := context.Background()
+	wc := newMapWebConnection()
+	clock := newFakeClock()
+	cwc := NewCachingWebConnection(wc, CacheConfig{RoomTTL: time.Minute})
+	cwc.setClock(clock)
+
+	room, err := cwc.GetRoom(ctx, "room1")
+	assert.NoError(t, err)
+	assert.Equal(t, wc.rooms["room1"], room)
+	room, err = cwc.GetRoom(ctx, "room1")
+	assert.NoError(t, err)
+	assert.Equal(t, wc.rooms["room1"], room)
+	assert.Equal(t, 1, wc.callCount())
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, cwc.Stats())
+
+	// once the TTL passes it is fetched again
+	clock.advance(2 * time.Minute)
+	_, err = cwc.GetRoom(ctx, "room1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, wc.callCount())
+
+	// errors aren't cached
+	_, err = cwc.GetRoom(ctx, "room-gone")
+	assert.Equal(t, errNoSuchThing, err)
+	_, err = cwc.GetRoom(ctx, "room-gone")
+	assert.Equal(t, errNoSuchThing, err)
+	assert.Equal(t, 4, wc.callCount())
+
+	// other kinds use the default TTL
+	_, err = cwc.GetLightpad(ctx, "pad1")
+	assert.NoError(t, err)
+	clock.advance(DefaultCacheTTL - time.Second)
+	_, err = cwc.GetLightpad(ctx, "pad1")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, wc.callCount())
+}
+
+func TestCachingWebConnectionInvalidate(t *testing.T) {
+	ctx := context.Background()
+	wc := newMapWebConnection()
+	cwc := NewCachingWebConnection(wc, CacheConfig{})
+
+	_, err := cwc.GetLogicalLoad(ctx, "load1")
+	assert.NoError(t, err)
+	cwc.InvalidateLogicalLoad("load1")
+	_, err = cwc.GetLogicalLoad(ctx, "load1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, wc.callCount())
+
+	// renaming passes through and drops the cached copy
+	_, err = cwc.GetRoom(ctx, "room1")
+	assert.NoError(t, err)
+	assert.NoError(t, cwc.RenameRoom(ctx, "room1", "den"))
+	_, err = cwc.GetRoom(ctx, "room1")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, wc.callCount())
+
+	cwc.InvalidateAll()
+	_, err = cwc.GetLogicalLoad(ctx, "load1")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, wc.callCount())
+	assert.Equal(t, uint64(0), cwc.Stats().Hits)
+}
+
+func TestCachingWebConnectionStale(t *testing.T) {
+	ctx := context.Background()
+	wc := newMapWebConnection()
+	clock := newFakeClock()
+	cwc := NewCachingWebConnection(wc, CacheConfig{
+		HouseTTL:             time.Minute,
+		StaleWhileRevalidate: time.Minute,
+	})
+	cwc.setClock(clock)
+
+	_, err := cwc.GetHouse(ctx, "house1")
+	assert.NoError(t, err)
+
+	// stale copies come straight back and are refreshed in the background
+	clock.advance(90 * time.Second)
+	house, err := cwc.GetHouse(ctx, "house1")
+	assert.NoError(t, err)
+	assert.Equal(t, "house1", house.ID)
+	assert.Equal(t, uint64(1), cwc.Stats().StaleHits)
+	assert.Eventually(t, func() bool {
+		return wc.callCount() == 2
+	}, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, err := cwc.GetHouse(ctx, "house1")
+		return err == nil && cwc.Stats().Hits == 1
+	}, time.Second, time.Millisecond)
+
+	// past the stale window it is a miss
+	clock.advance(3 * time.Minute)
+	_, err = cwc.GetHouse(ctx, "house1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), cwc.Stats().Misses)
+}
+
+// blockingWebConnection calls hook in the middle of each GetRoom, so tests can
+// act while a fetch is in flight
+type blockingWebConnection struct {
+	*mapWebConnection
+	hook func(context.Context) error
+}
+
+func (b *blockingWebConnection) GetRoom(ctx context.Context, rid string) (Room, error) {
+	if err := b.hook(ctx); err != nil {
+		return Room{}, err
+	}
+	return b.mapWebConnection.GetRoom(ctx, rid)
+}
+
+// waitFor returns a hook that blocks until release is closed
+func waitFor(release chan struct{}) func(context.Context) error {
+	return func(ctx context.Context) error {
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func TestCachingWebConnectionInvalidateDuringFetch(t *testing.T) {
+	ctx := context.Background()
+	for name, invalidate := range map[string]func(*CachingWebConnection){
+		"room": func(c *CachingWebConnection) { c.InvalidateRoom("room1") },
+		"all":  func(c *CachingWebConnection) { c.InvalidateAll() },
+	} {
+		wc := &blockingWebConnection{mapWebConnection: newMapWebConnection()}
+		cwc := NewCachingWebConnection(wc, CacheConfig{})
+		first := true
+		wc.hook = func(context.Context) error {
+			if first {
+				first = false
+				invalidate(cwc)
+			}
+			return nil
+		}
+		_, err := cwc.GetRoom(ctx, "room1")
+		assert.NoError(t, err)
+		// what was fetched before the invalidation isn't kept
+		_, err = cwc.GetRoom(ctx, "room1")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, wc.callCount(), name)
+		_, err = cwc.GetRoom(ctx, "room1")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, wc.callCount(), name)
+	}
+}
+
+func TestCachingWebConnectionSharedMiss(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	wc := &blockingWebConnection{
+		mapWebConnection: newMapWebConnection(),
+		hook:             waitFor(release),
+	}
+	cwc := NewCachingWebConnection(wc, CacheConfig{})
+
+	const callers = 5
+	rooms := make(chan Room, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			room, err := cwc.GetRoom(ctx, "room1")
+			assert.NoError(t, err)
+			rooms <- room
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		return cwc.Stats().Misses == callers
+	}, time.Second, time.Millisecond)
+	close(release)
+	for i := 0; i < callers; i++ {
+		assert.Equal(t, "room1", (<-rooms).ID)
+	}
+	assert.Equal(t, 1, wc.callCount())
+
+	// a caller that gives up doesn't fail the others sharing its call
+	release = make(chan struct{})
+	wc.hook = waitFor(release)
+	cwc.InvalidateRoom("room1")
+	cctx, cancel := context.WithCancel(ctx)
+	gaveUp := make(chan error)
+	go func() {
+		_, err := cwc.GetRoom(cctx, "room1")
+		gaveUp <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return cwc.Stats().Misses == callers+1
+	}, time.Second, time.Millisecond)
+	waited := make(chan error)
+	go func() {
+		_, err := cwc.GetRoom(ctx, "room1")
+		waited <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return cwc.Stats().Misses == callers+2
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-gaveUp)
+	close(release)
+	assert.NoError(t, <-waited)
+}
+
+func TestCachingWebConnectionMissCountedOnce(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	wc := &blockingWebConnection{
+		mapWebConnection: newMapWebConnection(),
+		hook:             waitFor(release),
+	}
+	cwc := NewCachingWebConnection(wc, CacheConfig{})
+
+	lctx, cancel := context.WithCancel(ctx)
+	leader := make(chan error)
+	go func() {
+		_, err := cwc.GetRoom(lctx, "room1")
+		leader <- err
+	}()
+	assert.Eventually(t, func() bool { return cwc.Stats().Misses == 1 }, time.Second, time.Millisecond)
+	waiter := make(chan error)
+	go func() {
+		_, err := cwc.GetRoom(ctx, "room1")
+		waiter <- err
+	}()
+	assert.Eventually(t, func() bool { return cwc.Stats().Misses == 2 }, time.Second, time.Millisecond)
+
+	// the waiter makes the call again itself when the leader gives up, but
+	// that's still the one miss
+	cancel()
+	assert.Equal(t, context.Canceled, <-leader)
+	close(release)
+	assert.NoError(t, <-waiter)
+	stats := cwc.Stats()
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(0), stats.Hits)
+}
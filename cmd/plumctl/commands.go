@@ -0,0 +1,402 @@
+package main
+
+// commands.go has the plumctl commands.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+)
+
+// DefaultPassiveWait is how long discover -passive listens when -wait isn't
+// given: a little over the interval between heartbeats, so every lightpad
+// should be heard once
+const DefaultPassiveWait = libplumraw.DefaultHeartbeatInterval + 30*time.Second
+
+// probeFlags are the flags of commands that look for lightpads on the network
+type probeFlags struct {
+	to   string
+	wait time.Duration
+}
+
+func (pf *probeFlags) add(fs *flag.FlagSet) {
+	fs.StringVar(&pf.to, "to", "", "send the probe to this `address` rather than broadcasting it, eg 192.168.1.255")
+	fs.DurationVar(&pf.wait, "wait", libplumraw.DefaultProbeWindow, "how long to wait for lightpads to answer")
+}
+
+// discover probes for lightpads
+func (pf *probeFlags) discover(ctx context.Context) ([]libplumraw.LightpadAnnouncement, error) {
+	p := &libplumraw.Probe{Window: pf.wait, Repeat: 3}
+	if pf.to != "" {
+		to := pf.to
+		if _, _, err := net.SplitHostPort(to); err != nil {
+			to = net.JoinHostPort(to, strconv.Itoa(libplumraw.DefaultLightpadHeartbeatPort))
+		}
+		addr, err := net.ResolveUDPAddr("udp", to)
+		if err != nil {
+			return nil, err
+		}
+		p.Addr = addr
+	}
+	return p.Discover(ctx)
+}
+
+// padFlags are the flags of commands that talk to one lightpad
+type padFlags struct {
+	lpid       string
+	ip         string
+	port       int
+	streamPort int
+	probe      probeFlags
+}
+
+func (pf *padFlags) add(fs *flag.FlagSet) {
+	fs.StringVar(&pf.lpid, "lpid", "", "`ID` of the lightpad (required)")
+	fs.StringVar(&pf.ip, "ip", "", "`address` of the lightpad, to skip probing for it")
+	fs.IntVar(&pf.port, "port", libplumraw.DefaultLightpadPort, "port of the lightpad's API, with -ip")
+	fs.IntVar(&pf.streamPort, "stream-port", libplumraw.DefaultLightpadStreamPort, "port of the lightpad's event stream")
+	pf.probe.add(fs)
+}
+
+// parsePadFlags is parseFlags for commands that talk to one lightpad
+func parsePadFlags(fs *flag.FlagSet, pf *padFlags, args []string, nargs int) error {
+	if err := parseFlags(fs, args, nargs); err != nil {
+		return err
+	}
+	if pf.lpid == "" {
+		fmt.Fprintf(fs.Output(), "plumctl %s: -lpid is required\n", fs.Name())
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// lightpad gets the lightpad's load and house access token from the web
+// service and finds it on the network, unless its address was given
+func (a *app) lightpad(ctx context.Context, pf *padFlags) (*libplumraw.DefaultLightpad, error) {
+	wc, err := a.webConnection()
+	if err != nil {
+		return nil, err
+	}
+	hids, err := wc.GetHouses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var factory *libplumraw.LightpadFactory
+	var errs []error
+	for _, hid := range hids {
+		f, err := libplumraw.NewLightpadFactory(ctx, wc, hid)
+		if f == nil {
+			return nil, err
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if containsID(f.Unheard(), pf.lpid) {
+			factory = f
+			break
+		}
+	}
+	if factory == nil {
+		return nil, errors.Join(append([]error{fmt.Errorf("lightpad %s isn't in the account", pf.lpid)}, errs...)...)
+	}
+	factory.Configure = func(lp *libplumraw.DefaultLightpad) {
+		lp.StreamPort = pf.streamPort
+	}
+
+	if pf.ip != "" {
+		ip := net.ParseIP(pf.ip)
+		if ip == nil {
+			return nil, fmt.Errorf("bad lightpad address %q", pf.ip)
+		}
+		return factory.Observe(libplumraw.LightpadAnnouncement{ID: pf.lpid, IP: ip, Port: pf.port}), nil
+	}
+	las, err := pf.probe.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, la := range las {
+		if la.ID == pf.lpid {
+			return factory.Observe(la), nil
+		}
+	}
+	return nil, fmt.Errorf("lightpad %s didn't answer the probe; give its address with -ip", pf.lpid)
+}
+
+func containsID(ids libplumraw.IDs, id string) bool {
+	for _, have := range ids {
+		if have == id {
+			return true
+		}
+	}
+	return false
+}
+
+func cmdList(ctx context.Context, a *app, args []string) error {
+	fs := a.flagSet("list", "")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	wc, err := a.webConnection()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+	hids, err := wc.GetHouses(ctx)
+	if err != nil {
+		return err
+	}
+	// show as much of the account as could be fetched
+	var errs []error
+	for _, hid := range hids {
+		topo, err := libplumraw.FetchHouseTopology(ctx, wc, hid, 0)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if topo != nil {
+			printTopology(a.stdout, topo)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func printTopology(w io.Writer, topo *libplumraw.HouseTopology) {
+	fmt.Fprintf(w, "house %s %q\n", topo.House.ID, topo.House.Name)
+	for _, rt := range topo.Rooms {
+		fmt.Fprintf(w, "  room %s %q\n", rt.Room.ID, rt.Room.Name)
+		for _, lt := range rt.LogicalLoads {
+			fmt.Fprintf(w, "    load %s %q\n", lt.LogicalLoad.ID, lt.LogicalLoad.Name)
+			for _, lp := range lt.Lightpads {
+				fmt.Fprintf(w, "      lightpad %s %q\n", lp.ID, lp.Name)
+			}
+		}
+	}
+	for _, scene := range topo.Scenes {
+		fmt.Fprintf(w, "  scene %s %q\n", scene.ID, scene.Name)
+	}
+}
+
+func cmdDiscover(ctx context.Context, a *app, args []string) error {
+	fs := a.flagSet("discover", "")
+	pf := probeFlags{}
+	pf.add(fs)
+	passive := fs.Bool("passive", false, "listen for heartbeats instead of probing; -wait defaults to "+DefaultPassiveWait.String()+" since lightpads send one every 5 minutes")
+	port := fs.Int("heartbeat-port", libplumraw.DefaultLightpadHeartbeatPort, "with -passive, the port to listen for heartbeats on")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *passive {
+		wait := DefaultPassiveWait
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "wait" {
+				wait = pf.wait
+			}
+		})
+		ctx, cancel := context.WithTimeout(ctx, wait)
+		defer cancel()
+		hb := &libplumraw.DefaultLightpadHeartbeat{Port: *port}
+		announcements, err := hb.Listen(ctx)
+		if err != nil {
+			return err
+		}
+		// print lightpads as they're heard rather than minutes later
+		seen := make(map[string]bool)
+		for la := range announcements {
+			if !seen[la.ID] {
+				seen[la.ID] = true
+				printAnnouncement(a.stdout, la)
+			}
+		}
+		if len(seen) == 0 {
+			return fmt.Errorf("no heartbeats heard in %s", wait)
+		}
+		return nil
+	}
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+	las, err := pf.discover(ctx)
+	if err != nil {
+		return err
+	}
+	if len(las) == 0 {
+		return fmt.Errorf("no lightpads answered the probe in %s", pf.wait)
+	}
+	for _, la := range las {
+		printAnnouncement(a.stdout, la)
+	}
+	return nil
+}
+
+func printAnnouncement(w io.Writer, la libplumraw.LightpadAnnouncement) {
+	fmt.Fprintf(w, "%s %s %d\n", la.ID, la.IP, la.Port)
+}
+
+func cmdSet(ctx context.Context, a *app, args []string) error {
+	fs := a.flagSet("set", "LEVEL")
+	pf := padFlags{}
+	pf.add(fs)
+	if err := parsePadFlags(fs, &pf, args, 1); err != nil {
+		return err
+	}
+	level, err := strconv.Atoi(fs.Arg(0))
+	if err != nil || level < 0 || level > 255 {
+		fmt.Fprintf(a.stderr, "plumctl set: level must be 0-255, not %q\n", fs.Arg(0))
+		return errUsage
+	}
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+	lp, err := a.lightpad(ctx, &pf)
+	if err != nil {
+		return err
+	}
+	return lp.SetLogicalLoadLevel(ctx, level)
+}
+
+func cmdGlow(ctx context.Context, a *app, args []string) error {
+	fs := a.flagSet("glow", "")
+	pf := padFlags{}
+	pf.add(fs)
+	color := libplumraw.LightpadGlowColor{}
+	fs.IntVar(&color.Red, "red", 0, "red, 0-255")
+	fs.IntVar(&color.Green, "green", 0, "green, 0-255")
+	fs.IntVar(&color.Blue, "blue", 0, "blue, 0-255")
+	fs.IntVar(&color.White, "white", 255, "white, 0-255")
+	intensity := fs.Float64("intensity", 1, "brightness, 0-1")
+	duration := fs.Duration("for", 5*time.Second, "how long to glow")
+	if err := parsePadFlags(fs, &pf, args, 0); err != nil {
+		return err
+	}
+	for _, c := range []int{color.Red, color.Green, color.Blue, color.White} {
+		if c < 0 || c > 255 {
+			fmt.Fprintf(a.stderr, "plumctl glow: colors must be 0-255\n")
+			return errUsage
+		}
+	}
+	if *intensity < 0 || *intensity > 1 {
+		fmt.Fprintf(a.stderr, "plumctl glow: intensity must be 0-1\n")
+		return errUsage
+	}
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+	lp, err := a.lightpad(ctx, &pf)
+	if err != nil {
+		return err
+	}
+	return lp.SetLogicalLoadGlow(ctx, libplumraw.ForceGlow{
+		LightpadGlowColor: color,
+		Intensity:         *intensity,
+		Timeout:           int(*duration / time.Millisecond),
+		LLID:              lp.LLID,
+	})
+}
+
+func cmdMetrics(ctx context.Context, a *app, args []string) error {
+	fs := a.flagSet("metrics", "")
+	pf := padFlags{}
+	pf.add(fs)
+	asJSON := fs.Bool("json", false, "print the metrics as JSON")
+	if err := parsePadFlags(fs, &pf, args, 0); err != nil {
+		return err
+	}
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+	lp, err := a.lightpad(ctx, &pf)
+	if err != nil {
+		return err
+	}
+	m, err := lp.GetLogicalLoadMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(a.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	}
+	fmt.Fprintf(a.stdout, "load %s level %d power %dW\n", lp.LLID, m.Level, m.Power)
+	for _, pm := range m.Metrics {
+		fmt.Fprintf(a.stdout, "  lightpad %s level %d power %dW\n", pm.ID, pm.Level, pm.Power)
+	}
+	return nil
+}
+
+func cmdWatch(ctx context.Context, a *app, args []string) error {
+	fs := a.flagSet("watch", "")
+	pf := padFlags{}
+	pf.add(fs)
+	asJSON := fs.Bool("json", false, "print each event as a line of JSON, in the format of libplumraw.Recorder")
+	if err := parsePadFlags(fs, &pf, args, 0); err != nil {
+		return err
+	}
+	findCtx, cancel := a.withTimeout(ctx)
+	lp, err := a.lightpad(findCtx, &pf)
+	cancel()
+	if err != nil {
+		return err
+	}
+	// watch until interrupted
+	events, err := lp.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	rec := libplumraw.NewRecorder(a.stdout)
+	for ev := range events {
+		switch {
+		case !*asJSON:
+			fmt.Fprintln(a.stdout, formatEvent(ev))
+		case len(ev.Raw()) == 0:
+			// connection changes aren't from the lightpad so can't be
+			// recorded; say what happened without spoiling the output
+			fmt.Fprintln(a.stderr, formatEvent(ev))
+		default:
+			if err := rec.Record(ev); err != nil {
+				return err
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.New("event stream closed")
+}
+
+// formatEvent describes the event on one line
+func formatEvent(ev libplumraw.Event) string {
+	var detail string
+	switch e := ev.(type) {
+	case libplumraw.LPEDimmerChange:
+		detail = fmt.Sprintf(" level=%d", e.Level)
+	case libplumraw.LPEPower:
+		detail = fmt.Sprintf(" watts=%d", e.Watts)
+	case libplumraw.LPEPIRSignal:
+		detail = fmt.Sprintf(" signal=%d", e.Signal)
+	case libplumraw.LPEConfigChange:
+		changes, _ := json.Marshal(e.Changes)
+		detail = fmt.Sprintf(" changes=%s", changes)
+	case libplumraw.LPETouch:
+		detail = fmt.Sprintf(" x=%d y=%d", e.X, e.Y)
+	case libplumraw.LPEGesture:
+		detail = fmt.Sprintf(" gesture=%s", e.Gesture)
+	case libplumraw.LPEConnected:
+		detail = fmt.Sprintf(" addr=%s", e.Addr)
+	case libplumraw.LPEDisconnected:
+		detail = fmt.Sprintf(" addr=%s", e.Addr)
+		if e.Err != nil {
+			detail += fmt.Sprintf(" err=%q", e.Err.Error())
+		}
+	case libplumraw.LPEError:
+		detail = fmt.Sprintf(" err=%q raw=%q", e.Err.Error(), e.Raw())
+	default:
+		detail = fmt.Sprintf(" raw=%s", ev.Raw())
+	}
+	return fmt.Sprintf("%s %s %s%s", ev.Time().Format("2006-01-02T15:04:05.000"), ev.LPID(), ev.Kind(), detail)
+}
@@ -0,0 +1,85 @@
+package main
+
+// config.go works out which Plum account to use.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/maplebed/libplumraw"
+)
+
+// credentials are the account details read from the config file, the
+// environment or flags
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// APIURL is only needed to use something other than the production web
+	// service
+	APIURL string `json:"api_url,omitempty"`
+}
+
+// loadCredentials merges the credentials from flags, the environment and the
+// config file, in that order of preference. filename is the -config flag; the
+// file it names must exist, whereas the default config file may be missing.
+func loadCredentials(filename string, flags credentials, getenv func(string) string) (credentials, error) {
+	explicit := filename != ""
+	if !explicit {
+		filename = getenv("PLUMCTL_CONFIG")
+		explicit = filename != ""
+	}
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err == nil {
+			filename = filepath.Join(dir, "plumctl", "config.json")
+		}
+	}
+	creds := credentials{}
+	if filename != "" {
+		buf, err := ioutil.ReadFile(filename)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(buf, &creds); err != nil {
+				return credentials{}, fmt.Errorf("reading config %s: %w", filename, err)
+			}
+		case explicit || !os.IsNotExist(err):
+			return credentials{}, err
+		}
+	}
+	creds.merge(credentials{
+		Email:    getenv("PLUM_EMAIL"),
+		Password: getenv("PLUM_PASSWORD"),
+		APIURL:   getenv("PLUM_API_URL"),
+	})
+	creds.merge(flags)
+	return creds, nil
+}
+
+// merge replaces the credentials with those in other that are set
+func (c *credentials) merge(other credentials) {
+	if other.Email != "" {
+		c.Email = other.Email
+	}
+	if other.Password != "" {
+		c.Password = other.Password
+	}
+	if other.APIURL != "" {
+		c.APIURL = other.APIURL
+	}
+}
+
+// webConnection connects to the Plum web service with the credentials
+func (a *app) webConnection() (libplumraw.WebConnection, error) {
+	if a.creds.Email == "" || a.creds.Password == "" {
+		return nil, errors.New("no Plum account: give -email and -password, set PLUM_EMAIL and PLUM_PASSWORD, or use a config file")
+	}
+	return libplumraw.NewWebConnection(libplumraw.WebConnectionConfig{
+		Email:      a.creds.Email,
+		Password:   a.creds.Password,
+		PlumAPIURL: a.creds.APIURL,
+	}), nil
+}
@@ -0,0 +1,187 @@
+// Command plumctl does everyday things with Plum lightpads from the command
+// line: list what's in an account, find lightpads on the network, set a load's
+// level, force a glow, read metrics and watch a lightpad's events.
+//
+// Usage:
+//
+//	plumctl [flags] command [command flags] [args]
+//
+// The commands are:
+//
+//	list      list the houses, rooms, loads, lightpads and scenes in the account
+//	discover  find lightpads on the network
+//	set       set a load's level, 0-255
+//	glow      force a lightpad's glow ring on for a while
+//	metrics   show a load's level and power
+//	watch     print a lightpad's events as they happen
+//
+// Commands that talk to a lightpad take its ID with -lpid. Its load and house
+// access token are fetched from the Plum web service and its address is found
+// by probing the network, unless it's given with -ip.
+//
+// The Plum account's email and password are taken from the -email and
+// -password flags, then the PLUM_EMAIL and PLUM_PASSWORD environment
+// variables, then the config file. The config file is JSON like
+//
+//	{"email": "me@example.com", "password": "secret"}
+//
+// and is read from -config, $PLUMCTL_CONFIG or plumctl/config.json in the
+// user's config directory (eg ~/.config on Linux), whichever is set first.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/maplebed/libplumraw"
+)
+
+// DefaultTimeout bounds each command, other than watch and passive discovery,
+// when -timeout isn't given
+const DefaultTimeout = 30 * time.Second
+
+// errUsage is returned by commands given bad arguments, after saying why
+var errUsage = errors.New("usage")
+
+type command struct {
+	run   func(ctx context.Context, a *app, args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"list":     {cmdList, "list the houses, rooms, loads, lightpads and scenes in the account"},
+	"discover": {cmdDiscover, "find lightpads on the network"},
+	"set":      {cmdSet, "set a load's level, 0-255"},
+	"glow":     {cmdGlow, "force a lightpad's glow ring on for a while"},
+	"metrics":  {cmdMetrics, "show a load's level and power"},
+	"watch":    {cmdWatch, "print a lightpad's events as they happen"},
+}
+
+// app is what every command needs
+type app struct {
+	stdout  io.Writer
+	stderr  io.Writer
+	creds   credentials
+	timeout time.Duration
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr, os.Getenv))
+}
+
+// run is plumctl with its arguments and surroundings passed in, returning the
+// exit status
+func run(ctx context.Context, args []string, stdout, stderr io.Writer, getenv func(string) string) int {
+	a := &app{
+		stdout: stdout,
+		stderr: stderr,
+	}
+	fs := flag.NewFlagSet("plumctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { usage(fs) }
+	config := fs.String("config", "", "config `file` with the account's credentials")
+	flagCreds := credentials{}
+	fs.StringVar(&flagCreds.Email, "email", "", "Plum account email")
+	fs.StringVar(&flagCreds.Password, "password", "", "Plum account password")
+	fs.StringVar(&flagCreds.APIURL, "api-url", "", "Plum web service `URL` (default "+libplumraw.DefaultPlumAPIHOST+")")
+	fs.DurationVar(&a.timeout, "timeout", DefaultTimeout, "give up on a command after this long")
+	debug := fs.Bool("debug", false, "log what the library is doing")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		usage(fs)
+		return 2
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "plumctl: unknown command %q\n", fs.Arg(0))
+		usage(fs)
+		return 2
+	}
+	if *debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	creds, err := loadCredentials(*config, flagCreds, getenv)
+	if err != nil {
+		fmt.Fprintf(stderr, "plumctl: %v\n", err)
+		return 1
+	}
+	a.creds = creds
+
+	err = cmd.run(ctx, a, fs.Args()[1:])
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	}
+	fmt.Fprintf(stderr, "plumctl: %v\n", err)
+	return 1
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "Usage: plumctl [flags] command [command flags] [args]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-9s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(w, "\nRun 'plumctl command -h' for the command's flags.\n\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+// flagSet returns the flags for a command. args describes the arguments that
+// follow the flags.
+func (a *app) flagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(a.stderr, "Usage: plumctl %s\n\nFlags:\n", strings.TrimSpace(name+" [flags] "+args))
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses a command's flags and checks it was given nargs
+// arguments after them
+func parseFlags(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != nargs {
+		fmt.Fprintf(fs.Output(), "plumctl %s: want %d arguments, got %d\n", fs.Name(), nargs, fs.NArg())
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// withTimeout bounds the context by -timeout, unless it's zero or less
+func (a *app) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, a.timeout)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+	"github.com/maplebed/libplumraw/plumtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer that's safe to write while a test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// house is an account in a fake Plum web service with one lightpad on the
+// network
+type house struct {
+	cloud *plumtest.Cloud
+	pad   *plumtest.VirtualLightpad
+	probe *plumtest.ProbeResponder
+}
+
+func newHouse() *house {
+	cloud := plumtest.NewCloud("me@example.com", "secret")
+	cloud.AddHouse(libplumraw.House{ID: "house1", Name: "Home", AccessToken: "hat"})
+	cloud.AddRoom(libplumraw.Room{ID: "room1", HouseID: "house1", Name: "Kitchen"})
+	cloud.AddLogicalLoad(libplumraw.LogicalLoad{ID: "load1", RoomID: "room1", Name: "Pendants"})
+	cloud.AddLightpad(libplumraw.LightpadSpec{ID: "pad1", LLID: "load1", Name: "By the door"})
+	pad := plumtest.NewVirtualLightpad("pad1", "hat", plumtest.NewVirtualLoad("load1"))
+	return &house{
+		cloud: cloud,
+		pad:   pad,
+		probe: plumtest.NewProbeResponder(pad),
+	}
+}
+
+func (h *house) Close() {
+	h.probe.Close()
+	h.pad.Close()
+	h.cloud.Close()
+}
+
+// run runs plumctl against the house, returning its exit status and output
+func (h *house) run(ctx context.Context, env map[string]string, args ...string) (int, string, string) {
+	stdout, stderr := &syncBuffer{}, &syncBuffer{}
+	status := h.runTo(ctx, stdout, stderr, env, args...)
+	return status, stdout.String(), stderr.String()
+}
+
+func (h *house) runTo(ctx context.Context, stdout, stderr *syncBuffer, env map[string]string, args ...string) int {
+	if env == nil {
+		env = map[string]string{
+			"PLUM_EMAIL":     "me@example.com",
+			"PLUM_PASSWORD":  "secret",
+			"PLUMCTL_CONFIG": "",
+		}
+	}
+	args = append([]string{"-api-url", h.cloud.URL(), "-timeout", "5s"}, args...)
+	getenv := func(key string) string { return env[key] }
+	return run(ctx, args, stdout, stderr, getenv)
+}
+
+// padArgs are the flags to reach the lightpad with a probe
+func (h *house) padArgs() []string {
+	return []string{
+		"-lpid", "pad1",
+		"-to", h.probe.Addr().String(),
+		"-wait", "200ms",
+		"-stream-port", strconv.Itoa(h.pad.Stream().Addr().Port),
+	}
+}
+
+func TestList(t *testing.T) {
+	h := newHouse()
+	defer h.Close()
+	status, stdout, stderr := h.run(context.Background(), nil, "list")
+	assert.Equal(t, 0, status, stderr)
+	assert.Equal(t, `house house1 "Home"
+  room room1 "Kitchen"
+    load load1 "Pendants"
+      lightpad pad1 "By the door"
+`, stdout)
+}
+
+func TestCredentials(t *testing.T) {
+	h := newHouse()
+	defer h.Close()
+	ctx := context.Background()
+
+	status, _, stderr := h.run(ctx, map[string]string{}, "list")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr, "no Plum account")
+
+	// flags win over the environment
+	status, _, stderr = h.run(ctx, map[string]string{"PLUM_EMAIL": "me@example.com", "PLUM_PASSWORD": "wrong"},
+		"-password", "secret", "list")
+	assert.Equal(t, 0, status, stderr)
+
+	dir, err := ioutil.TempDir("", "plumctl")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config.json")
+	assert.NoError(t, ioutil.WriteFile(config, []byte(`{"email": "me@example.com", "password": "secret"}`), 0600))
+	status, _, stderr = h.run(ctx, map[string]string{"PLUMCTL_CONFIG": config}, "list")
+	assert.Equal(t, 0, status, stderr)
+
+	// a config file that was asked for must be there
+	status, _, stderr = h.run(ctx, map[string]string{}, "-config", filepath.Join(dir, "missing.json"), "list")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr, "missing.json")
+}
+
+func TestDiscover(t *testing.T) {
+	h := newHouse()
+	defer h.Close()
+	status, stdout, stderr := h.run(context.Background(), nil, "discover", "-to", h.probe.Addr().String(), "-wait", "200ms")
+	assert.Equal(t, 0, status, stderr)
+	assert.Equal(t, "pad1 127.0.0.1 "+strconv.Itoa(h.pad.Port())+"\n", stdout)
+
+	h.probe.Close()
+	status, _, stderr = h.run(context.Background(), nil, "discover", "-to", h.probe.Addr().String(), "-wait", "100ms")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr, "no lightpads answered")
+}
+
+func TestSetGlowMetrics(t *testing.T) {
+	h := newHouse()
+	defer h.Close()
+	ctx := context.Background()
+
+	status, _, stderr := h.run(ctx, nil, append([]string{"set"}, append(h.padArgs(), "128")...)...)
+	assert.Equal(t, 0, status, stderr)
+	assert.Equal(t, 128, h.pad.Load().Level())
+
+	// the address can be given instead of probing for it
+	status, _, stderr = h.run(ctx, nil, "glow", "-lpid", "pad1", "-ip", "127.0.0.1",
+		"-port", strconv.Itoa(h.pad.Port()), "-red", "255", "-white", "0", "-for", "2s")
+	assert.Equal(t, 0, status, stderr)
+	glow := h.pad.Glow()
+	assert.Equal(t, 255, glow.Red)
+	assert.Equal(t, 0, glow.White)
+	assert.Equal(t, 2000, glow.Timeout)
+
+	status, stdout, stderr := h.run(ctx, nil, append([]string{"metrics"}, h.padArgs()...)...)
+	assert.Equal(t, 0, status, stderr)
+	assert.Equal(t, "load load1 level 128 power 30W\n  lightpad pad1 level 128 power 30W\n", stdout)
+	status, stdout, stderr = h.run(ctx, nil, append([]string{"metrics", "-json"}, h.padArgs()...)...)
+	assert.Equal(t, 0, status, stderr)
+	m := libplumraw.LogicalLoadMetrics{}
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &m))
+	assert.Equal(t, 128, m.Level)
+}
+
+func TestUsage(t *testing.T) {
+	h := newHouse()
+	defer h.Close()
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{},
+		{"frobnicate"},
+		{"set", "-lpid", "pad1"},
+		{"set", "-lpid", "pad1", "300"},
+		{"set", "128"},
+		{"glow", "-lpid", "pad1", "-intensity", "2"},
+	} {
+		status, _, stderr := h.run(ctx, nil, args...)
+		assert.Equal(t, 2, status, "%v", args)
+		assert.NotEmpty(t, stderr, "%v", args)
+	}
+
+	status, _, stderr := h.run(ctx, nil, "set", "-lpid", "pad-gone", "-ip", "127.0.0.1", "1")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr, "pad-gone isn't in the account")
+}
+
+func TestWatch(t *testing.T) {
+	for _, asJSON := range []bool{false, true} {
+		h := newHouse()
+		ctx, cancel := context.WithCancel(context.Background())
+		stdout, stderr := &syncBuffer{}, &syncBuffer{}
+		args := append([]string{"watch"}, h.padArgs()...)
+		if asJSON {
+			args = append(args, "-json")
+		}
+		// connection changes are only among the events when they aren't JSON
+		want := 3
+		if asJSON {
+			want = 2
+		}
+		done := make(chan int)
+		go func() { done <- h.runTo(ctx, stdout, stderr, nil, args...) }()
+		assert.NoError(t, h.pad.Stream().WaitForClients(1, 5*time.Second))
+		h.pad.Load().SetLevel(255)
+		deadline := time.Now().Add(5 * time.Second)
+		for strings.Count(stdout.String(), "\n") < want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		assert.Equal(t, 0, <-done, stderr.String())
+
+		lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+		if asJSON {
+			// the output can be replayed
+			recs, err := libplumraw.ReadRecording(strings.NewReader(stdout.String()))
+			assert.NoError(t, err)
+			if assert.Len(t, recs, 2) {
+				assert.Equal(t, "pad1", recs[0].LPID)
+			}
+			assert.Contains(t, stderr.String(), "connected")
+		} else if assert.True(t, len(lines) >= want) {
+			// the stream might also be seen to disconnect
+			assert.Contains(t, lines[0], "pad1 connected addr=")
+			assert.Contains(t, lines[1], "pad1 dimmerchange level=255")
+			assert.Contains(t, lines[2], "pad1 power watts=60")
+		}
+		h.Close()
+	}
+}
+
+func TestDiscoverPassive(t *testing.T) {
+	h := newHouse()
+	defer h.Close()
+	ctx := context.Background()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	// nothing heard is an error
+	status, stdout, stderr := h.run(ctx, nil, "discover", "-passive", "-heartbeat-port", strconv.Itoa(port), "-wait", "100ms")
+	assert.Equal(t, 1, status)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "no heartbeats heard in 100ms")
+
+	h.pad.StartHeartbeats(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, 20*time.Millisecond)
+	status, stdout, stderr = h.run(ctx, nil, "discover", "-passive", "-heartbeat-port", strconv.Itoa(port), "-wait", "300ms")
+	assert.Equal(t, 0, status, stderr)
+	// each lightpad is listed once however many heartbeats it sends
+	assert.Equal(t, "pad1 127.0.0.1 "+strconv.Itoa(h.pad.Port())+"\n", stdout)
+}
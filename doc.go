@@ -16,16 +16,29 @@ Use
 To issue calls out to the website (to get house, room, etc. configs), first get
 a `WebConnection` by calling `NewWebConnection()` with a `WebConnectionConfig`
 (`Email` and `Password` are required, `PlumAPIHost` is optional). Use the
-returned connection object to call out to the website.
+returned connection object to call out to the website. Each call takes a
+`context.Context`; cancel it or give it a deadline to abandon a slow request.
+Besides fetching configs, the connection can create, update and delete scenes
+and rename rooms, logical loads and lightpads.
+`FetchHouseTopology()` fetches a house and every room, logical load, lightpad
+and scene in it concurrently and links them together.
+`NewCachingWebConnection()` wraps a `WebConnection` to avoid fetching the same
+objects over and over. `ExportSnapshot()` saves a whole account to a file and
+`NewSnapshotWebConnection()` serves it back so you can start up while the Plum
+web service is unreachable.
+
+Failed calls return a `*StatusError`, `*DecodeError` or `*RequestError`. Use
+`errors.Is()` with `ErrUnauthorized`, `ErrNotFound`, `ErrThrottled`,
+`ErrServer`, `ErrMalformedResponse` or `ErrTimeout` to tell what went wrong.
 
 There are three places from which you get information about Lightpads.
 
     * the general config comes from the Plum web service
     ** use `WebConnection.GetLightpad()` to fetch this data
     * the IP and Port come from the Heartbeat broadcast
-    ** use `DefaultLightpadHeartbeat{}.Listen() to receive these messages
+    ** use `DefaultLightpadHeartbeat{}.Listen()` to receive these messages
     * live changes to state come from a stream the lightpad itself produces
-    ** use `Lightpad.Stream()` to get these updates
+    ** use `Lightpad.Subscribe()` to get these updates
 
 To interact with a Lightpad, you need to get its general config (including, for
 example, the `Room` in which it exists) from the web. You then must merge that
@@ -35,6 +48,27 @@ the current state of the switch. It is recomemended that you store this state
 locally to avoid waiting 5 minutes for the heartbeat before being able to
 interact with a Lightpad switch.
 
+A `Registry` from `NewRegistry()` does the listening for you: `Registry.Run()`
+keeps the latest address of every lightpad heard from, notices lightpads that
+stop sending heartbeats, and lets you look them up by LPID or LLID.
+Rather than wait for the next heartbeat, `Probe.Discover()` asks every lightpad
+on the network to announce itself straight away. To remember addresses across
+restarts, `OpenAddressCache()` loads them from a file and
+`AddressCache.Run()` keeps it up to date from the heartbeats; at startup, feed
+`AddressCache.Announcements()` to a `Registry` or `LightpadFactory` with their
+`Observe()` methods.
+`NewLightpadFactory()` does the merging: it fetches a house and hands out a
+ready to use `DefaultLightpad` for each of its lightpads as they are heard
+from, following them when they move to a new address.
+`FetchHouseState()` keeps the state for you: feed its `HouseState.Watch()`
+with a `Registry` subscription and the lightpads' events, then read the
+current level, wattage and last motion of each load and lightpad with
+`HouseState.Snapshot()` or follow them with `HouseState.Subscribe()`.
+
+When several parts of a program want the same events, add the lightpads to a
+`Hub` from `NewHub()` so each switch has one connection, and give each reader
+its own `Hub.Subscribe()` with an `EventFilter`.
+
 Testing code that uses libplumraw
 
 When testing code that uses `libplumraw`, create a `TestWebConnection{}` object
@@ -45,5 +79,9 @@ objects instead of making calls out to the website. This will give you
 predictable responses you can use to exercise your code.  For Lightpads, use a
 `TestLightpad{}` struct instead of the actual one with similar effects.
 
+To exercise the real connection end to end, start a fake Plum web service with
+`plumtest.NewCloud()`, fill it with an account and hand its `Config()` to
+`NewWebConnection()`.
+
 */
 package libplumraw
@@ -0,0 +1,165 @@
+package libplumraw
+
+// errors.go has the errors returned when a call to the Plum web service or to
+// a lightpad fails. Check for a class of failure with errors.Is against one of
+// the Err* sentinels, or get at the details with errors.As and one of the
+// *Error types.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrUnauthorized matches failures where the email and password (or, for a
+	// lightpad, the house access token) were rejected
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound matches failures where the ID asked about doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrThrottled matches failures where the service asked us to slow down
+	ErrThrottled = errors.New("throttled")
+	// ErrServer matches failures where the service reported an error of its own
+	ErrServer = errors.New("server error")
+	// ErrMalformedResponse matches responses whose body couldn't be decoded
+	ErrMalformedResponse = errors.New("malformed response")
+	// ErrTimeout matches requests that got no response in time, whether from a
+	// network timeout or the context's deadline passing
+	ErrTimeout = errors.New("timeout")
+)
+
+// maxErrorBodyLen is how much of a response body is kept in an error
+const maxErrorBodyLen = 512
+
+// StatusError is returned when a request got a response with an unexpected
+// HTTP status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// Path is the API path of the endpoint called
+	Path string
+	// ID is the ID of the object the call was about, if any. For lightpad
+	// calls this is the LLID.
+	ID string
+	// Body is the start of the response body
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%s failed: status %s", describeCall(e.Path, e.ID), e.Status)
+	if e.Body != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Body)
+	}
+	return msg
+}
+
+// Is matches the sentinel for the class of the status code
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrThrottled:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// DecodeError is returned when a response body could not be decoded.
+type DecodeError struct {
+	Path string
+	ID   string
+	// Body is the start of the response body
+	Body string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s failed: couldn't decode response: %s", describeCall(e.Path, e.ID), e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// Is matches ErrMalformedResponse
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrMalformedResponse
+}
+
+// RequestError is returned when a request could not be made or got no response,
+// including when the context was cancelled or its deadline passed. The
+// underlying error is available with errors.Is and errors.As, so for example
+// errors.Is(err, context.Canceled) is true for a cancelled call.
+type RequestError struct {
+	Path string
+	ID   string
+	Err  error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s failed: %s", describeCall(e.Path, e.ID), e.Err)
+}
+
+func (e *RequestError) Unwrap() error { return e.Err }
+
+// Is matches ErrTimeout when the request timed out
+func (e *RequestError) Is(target error) bool {
+	if target != ErrTimeout {
+		return false
+	}
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(e.Err, &ne) && ne.Timeout()
+}
+
+func describeCall(path, id string) string {
+	if id == "" {
+		return path
+	}
+	return fmt.Sprintf("%s for %s", path, id)
+}
+
+// checkResponse returns a *StatusError if the response's status is not one of
+// the wanted ones
+func checkResponse(resp *http.Response, path, id string, wanted ...int) error {
+	for _, status := range wanted {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLen))
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Path:       path,
+		ID:         id,
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
+
+// decodeResponse decodes the JSON response body into v, returning a
+// *DecodeError if it is malformed
+func decodeResponse(resp *http.Response, path, id string, v interface{}) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &RequestError{Path: path, ID: id, Err: err}
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		if len(body) > maxErrorBodyLen {
+			body = body[:maxErrorBodyLen]
+		}
+		return &DecodeError{Path: path, ID: id, Body: string(body), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package libplumraw
+
+// events.go has the events a lightpad reports on its event stream.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// LightpadEventType says what kind of thing an Event reports
+type LightpadEventType uint32
+
+const (
+	UndefEvent LightpadEventType = iota
+	DimmerChange
+	Power
+	PIRSignal
+	ConfigChange
+	// Connected and Disconnected report the state of the event stream itself
+	Connected
+	Disconnected
+	// StreamError is an event that couldn't be understood
+	StreamError
+	Touch
+	Gesture
+)
+
+var eventTypeNames = map[LightpadEventType]string{
+	UndefEvent:   "unknown",
+	DimmerChange: "dimmerchange",
+	Power:        "power",
+	PIRSignal:    "pirSignal",
+	ConfigChange: "configchange",
+	Connected:    "connected",
+	Disconnected: "disconnected",
+	StreamError:  "error",
+	Touch:        "touch",
+	Gesture:      "gesture",
+}
+
+// String is the name the lightpad uses for the event type
+func (t LightpadEventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("LightpadEventType(%d)", uint32(t))
+}
+
+// Event is what's emitted from the lightpad when it changes state.
+// Examples: load change, PIR activated, etc. Type switch on the concrete LPE
+// types for the details of each kind of event.
+type Event interface {
+	// Kind says which of the LPE types the event is
+	Kind() LightpadEventType
+	// LPID is the lightpad the event came from
+	LPID() string
+	// LLID is the logical load of the lightpad the event came from
+	LLID() string
+	// Time is when the event was received
+	Time() time.Time
+	// Seq numbers the events from one subscription, starting at 1, so gaps
+	// show when events were lost
+	Seq() uint64
+	// Raw is the message as the lightpad sent it. It is empty for events
+	// made up by the library and might not be valid JSON for a StreamError.
+	Raw() json.RawMessage
+}
+
+// LightpadEvent is what all events have in common. It is embedded in each of
+// the LPE types.
+type LightpadEvent struct {
+	// Type is the type as named by the lightpad
+	Type          string          `json:"type"`
+	LightpadID    string          `json:"-"`
+	LogicalLoadID string          `json:"-"`
+	Received      time.Time       `json:"-"`
+	Sequence      uint64          `json:"-"`
+	Message       json.RawMessage `json:"-"`
+}
+
+func (e LightpadEvent) LPID() string         { return e.LightpadID }
+func (e LightpadEvent) LLID() string         { return e.LogicalLoadID }
+func (e LightpadEvent) Time() time.Time      { return e.Received }
+func (e LightpadEvent) Seq() uint64          { return e.Sequence }
+func (e LightpadEvent) Raw() json.RawMessage { return e.Message }
+
+// LPEUnknown is a well formed event of a type this library doesn't know
+type LPEUnknown struct {
+	LightpadEvent
+}
+
+// LPEDimmerChange is sent when the load's level changes
+type LPEDimmerChange struct {
+	LightpadEvent
+	Level int `json:"level"`
+}
+
+// LPEPower reports how much power the load is drawing
+type LPEPower struct {
+	LightpadEvent
+	Watts int `json:"watts"`
+}
+
+// LPEPIRSignal is sent when the lightpad's motion sensor is triggered
+type LPEPIRSignal struct {
+	LightpadEvent
+	Signal int `json:"signal"`
+}
+
+// LPEConfigChange is sent when the lightpad's configuration changes. Changes
+// has only the settings that changed filled in.
+type LPEConfigChange struct {
+	LightpadEvent
+	Changes LightpadConfig `json:"changes"`
+}
+
+// LPETouch is sent when someone touches the lightpad, with where it was
+// touched
+type LPETouch struct {
+	LightpadEvent
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// LPEGesture is sent when the lightpad recognizes a gesture, such as a swipe
+// or a tap. Gesture is the name the lightpad gives it.
+type LPEGesture struct {
+	LightpadEvent
+	Gesture string `json:"gesture"`
+}
+
+// LPEConnected is sent each time the event stream connects to the lightpad,
+// including after reconnecting
+type LPEConnected struct {
+	LightpadEvent
+	Addr string
+}
+
+// LPEDisconnected is sent when the event stream to the lightpad drops. Events
+// may have been missed until the next LPEConnected.
+type LPEDisconnected struct {
+	LightpadEvent
+	Addr string
+	Err  error
+}
+
+// LPEError is sent in place of a message from the lightpad that couldn't be
+// parsed. Raw has the message.
+type LPEError struct {
+	LightpadEvent
+	Err error
+}
+
+func (e LPEUnknown) Kind() LightpadEventType      { return UndefEvent }
+func (e LPEDimmerChange) Kind() LightpadEventType { return DimmerChange }
+func (e LPEPower) Kind() LightpadEventType        { return Power }
+func (e LPEPIRSignal) Kind() LightpadEventType    { return PIRSignal }
+func (e LPEConfigChange) Kind() LightpadEventType { return ConfigChange }
+func (e LPEConnected) Kind() LightpadEventType    { return Connected }
+func (e LPEDisconnected) Kind() LightpadEventType { return Disconnected }
+func (e LPEError) Kind() LightpadEventType        { return StreamError }
+func (e LPETouch) Kind() LightpadEventType        { return Touch }
+func (e LPEGesture) Kind() LightpadEventType      { return Gesture }
+
+// DecodeLightpadEvent decodes one message from a lightpad's event stream. The
+// trailing "." lightpads put after each message is optional. Messages of an
+// unknown type come back as an LPEUnknown and messages that can't be decoded
+// as an LPEError; either way Raw has the message. The event's LPID, LLID,
+// Time and Seq are left empty.
+func DecodeLightpadEvent(msg []byte) Event {
+	return decodeEvent(LightpadEvent{}, msg)
+}
+
+// decodeEvent decodes msg into an event built on base
+func decodeEvent(base LightpadEvent, msg []byte) Event {
+	msg = bytes.TrimSuffix(bytes.TrimSpace(msg), []byte("."))
+	base.Message = append(json.RawMessage(nil), msg...)
+	base.Type = ""
+	if len(msg) == 0 {
+		base.Type = StreamError.String()
+		return LPEError{base, errors.New("empty message")}
+	}
+	if err := json.Unmarshal(msg, &base); err != nil {
+		base.Type = StreamError.String()
+		return LPEError{base, err}
+	}
+	var ev Event
+	var err error
+	switch base.Type {
+	case "dimmerchange":
+		e := LPEDimmerChange{LightpadEvent: base}
+		err = json.Unmarshal(msg, &e)
+		ev = e
+	case "power":
+		e := LPEPower{LightpadEvent: base}
+		err = json.Unmarshal(msg, &e)
+		ev = e
+	case "pirSignal":
+		e := LPEPIRSignal{LightpadEvent: base}
+		err = json.Unmarshal(msg, &e)
+		ev = e
+	case "configchange":
+		e := LPEConfigChange{LightpadEvent: base}
+		err = json.Unmarshal(msg, &e)
+		ev = e
+	case "touch":
+		e := LPETouch{LightpadEvent: base}
+		err = json.Unmarshal(msg, &e)
+		ev = e
+	case "gesture":
+		e := LPEGesture{LightpadEvent: base}
+		err = json.Unmarshal(msg, &e)
+		ev = e
+	default:
+		return LPEUnknown{base}
+	}
+	if err != nil {
+		return LPEError{base, err}
+	}
+	return ev
+}
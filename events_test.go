@@ -0,0 +1,140 @@
+package libplumraw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeLightpadEvent(t *testing.T) {
+	tests := []struct {
+		message string
+		exp     Event
+	}{
+		{`{"type":"dimmerchange","level":10}`, LPEDimmerChange{LightpadEvent{Type: "dimmerchange"}, 10}},
+		{`{"type":"dimmerchange","level":10}.`, LPEDimmerChange{LightpadEvent{Type: "dimmerchange"}, 10}},
+		{"  {\"type\":\"power\",\"watts\":60}.\r\n", LPEPower{LightpadEvent{Type: "power"}, 60}},
+		{`{"type":"pirSignal","signal":1}`, LPEPIRSignal{LightpadEvent{Type: "pirSignal"}, 1}},
+		{
+			`{"type":"configchange","changes":{"glowColor":{"red":255,"green":0,"blue":0,"white":0},"glowIntensity":0.5}}`,
+			LPEConfigChange{LightpadEvent{Type: "configchange"}, LightpadConfig{
+				GlowColor:     LightpadGlowColor{Red: 255},
+				GlowIntensity: 0.5,
+			}},
+		},
+		{`{"type":"touch","x":12,"y":200}`, LPETouch{LightpadEvent{Type: "touch"}, 12, 200}},
+		{`{"type":"gesture","gesture":"swipeup"}`, LPEGesture{LightpadEvent{Type: "gesture"}, "swipeup"}},
+		{`{"type":"mystery","level":3}`, LPEUnknown{LightpadEvent{Type: "mystery"}}},
+		{`{"level":3}`, LPEUnknown{LightpadEvent{}}},
+	}
+	for _, tt := range tests {
+		ev := DecodeLightpadEvent([]byte(tt.message))
+		assert.Equal(t, tt.exp.Kind(), ev.Kind(), tt.message)
+		assert.JSONEq(t, tt.message[:len(tt.message)-len(trailing(tt.message))], string(ev.Raw()), tt.message)
+		assert.Equal(t, tt.exp, withoutRaw(ev), tt.message)
+	}
+}
+
+func TestDecodeLightpadEventErrors(t *testing.T) {
+	tests := []struct {
+		message string
+		typ     string
+	}{
+		{`{"type":"power","watts":"lots"}`, "power"},
+		{`{"type":"configchange","changes":[]}`, "configchange"},
+		{`garbage`, "error"},
+		{`[1,2]`, "error"},
+		{`{"type":"power"`, "error"},
+		{``, "error"},
+		{`.`, "error"},
+	}
+	for _, tt := range tests {
+		ev := DecodeLightpadEvent([]byte(tt.message))
+		e, ok := ev.(LPEError)
+		if !assert.True(t, ok, tt.message) {
+			continue
+		}
+		assert.Equal(t, StreamError, e.Kind(), tt.message)
+		assert.Error(t, e.Err, tt.message)
+		assert.Equal(t, tt.typ, e.Type, tt.message)
+		assert.Equal(t, tt.message, string(e.Raw())+trailing(tt.message), tt.message)
+	}
+}
+
+func TestDecodeLightpadEventCopies(t *testing.T) {
+	msg := []byte(`{"type":"power","watts":60}`)
+	ev := DecodeLightpadEvent(msg)
+	copy(msg, "xxxxxxxx")
+	assert.Equal(t, `{"type":"power","watts":60}`, string(ev.Raw()))
+}
+
+func TestLightpadEventTypeString(t *testing.T) {
+	assert.Equal(t, "dimmerchange", DimmerChange.String())
+	assert.Equal(t, "configchange", ConfigChange.String())
+	assert.Equal(t, "disconnected", Disconnected.String())
+	assert.Equal(t, "LightpadEventType(99)", LightpadEventType(99).String())
+}
+
+func FuzzDecodeLightpadEvent(f *testing.F) {
+	for _, seed := range []string{
+		`{"type":"dimmerchange","level":10}.`,
+		`{"type":"power","watts":60}`,
+		`{"type":"pirSignal","signal":1}`,
+		`{"type":"configchange","changes":{"glowIntensity":0.5}}`,
+		`{"type":"touch","x":12,"y":200}`,
+		`{"type":"gesture","gesture":"tap"}`,
+		`{"type":"mystery"}`,
+		`garbage`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		ev := DecodeLightpadEvent(msg)
+		if ev == nil {
+			t.Fatal("no event")
+		}
+		if e, ok := ev.(LPEError); ok && e.Err == nil {
+			t.Fatal("error event without an error")
+		}
+		if _, ok := eventTypeNames[ev.Kind()]; !ok {
+			t.Fatalf("unnamed kind %d", ev.Kind())
+		}
+	})
+}
+
+// trailing is what DecodeLightpadEvent trims from the end of a message
+func trailing(msg string) string {
+	n := len(msg)
+	for n > 0 && (msg[n-1] == '\n' || msg[n-1] == '\r' || msg[n-1] == ' ' || msg[n-1] == '.') {
+		n--
+	}
+	return msg[n:]
+}
+
+// withoutRaw clears the raw message so decoded events can be compared
+func withoutRaw(ev Event) Event {
+	switch e := ev.(type) {
+	case LPEDimmerChange:
+		e.Message = nil
+		return e
+	case LPEPower:
+		e.Message = nil
+		return e
+	case LPEPIRSignal:
+		e.Message = nil
+		return e
+	case LPEConfigChange:
+		e.Message = nil
+		return e
+	case LPETouch:
+		e.Message = nil
+		return e
+	case LPEGesture:
+		e.Message = nil
+		return e
+	case LPEUnknown:
+		e.Message = nil
+		return e
+	}
+	return ev
+}
@@ -0,0 +1,202 @@
+package libplumraw
+
+// factory.go puts together what the Plum web service knows about a house's
+// lightpads with the addresses they announce on the network, giving lightpads
+// that are ready to use.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// LightpadFactory builds a DefaultLightpad for each lightpad in a house once
+// it is heard from on the network, and keeps its address up to date when it
+// announces a new one. Feed it with Run, or with Observe from some other
+// source of announcements such as a Probe or an AddressCache.
+type LightpadFactory struct {
+	// Configure, if set, is called with each lightpad before it is handed out,
+	// to set things like its HttpClient, Timeout or Retry
+	Configure func(*DefaultLightpad)
+
+	house House
+
+	mu    sync.Mutex
+	specs map[string]LightpadSpec
+	pads  map[string]*DefaultLightpad
+	subs  map[chan *DefaultLightpad]struct{}
+}
+
+// NewLightpadFactory fetches the house with FetchHouseTopology and returns a
+// factory for the lightpads in it. If some of the house couldn't be fetched,
+// the factory for the lightpads that could is returned along with the
+// *PartialFetchError.
+func NewLightpadFactory(ctx context.Context, wc WebConnection, hid string) (*LightpadFactory, error) {
+	topo, err := FetchHouseTopology(ctx, wc, hid, 0)
+	if topo == nil {
+		return nil, err
+	}
+	return newLightpadFactory(topo), err
+}
+
+func newLightpadFactory(topo *HouseTopology) *LightpadFactory {
+	f := &LightpadFactory{
+		house: topo.House,
+		specs: make(map[string]LightpadSpec),
+		pads:  make(map[string]*DefaultLightpad),
+		subs:  make(map[chan *DefaultLightpad]struct{}),
+	}
+	for _, rt := range topo.Rooms {
+		for _, lt := range rt.LogicalLoads {
+			for _, spec := range lt.Lightpads {
+				f.specs[spec.ID] = spec
+			}
+		}
+	}
+	return f
+}
+
+// House is the house the factory was made for
+func (f *LightpadFactory) House() House {
+	return f.house
+}
+
+// Run listens for heartbeats and resolves lightpads from them until the
+// context is done. It returns an error if the listener can't be started,
+// otherwise nil once the context is done.
+func (f *LightpadFactory) Run(ctx context.Context, hl HeartbeatListener) error {
+	announcements, err := hl.Listen(ctx)
+	if err != nil {
+		return err
+	}
+	for la := range announcements {
+		f.Observe(la)
+	}
+	return nil
+}
+
+// Observe records an announcement. The first time a lightpad in the house is
+// heard from, a DefaultLightpad is made for it; after that its address is
+// updated in place with SetAddress, so lightpads already handed out follow it
+// when it moves. It returns the lightpad, or nil if the announcement is from a
+// lightpad that isn't in the house. Configure is called without the factory
+// locked, so it may use the factory.
+func (f *LightpadFactory) Observe(la LightpadAnnouncement) *DefaultLightpad {
+	f.mu.Lock()
+	spec, ok := f.specs[la.ID]
+	lp, heard := f.pads[la.ID]
+	if heard {
+		follow(lp, la)
+	}
+	f.mu.Unlock()
+	if !ok || heard {
+		return lp
+	}
+
+	lp = &DefaultLightpad{
+		ID:   spec.ID,
+		LLID: spec.LLID,
+		IP:   la.IP,
+		Port: la.Port,
+		HAT:  f.house.AccessToken,
+	}
+	if f.Configure != nil {
+		f.Configure(lp)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// another announcement from the lightpad may have got in while it was
+	// being configured
+	if first, ok := f.pads[la.ID]; ok {
+		follow(first, la)
+		return first
+	}
+	f.pads[la.ID] = lp
+	for ch := range f.subs {
+		select {
+		case ch <- lp:
+		default:
+		}
+	}
+	return lp
+}
+
+// follow moves the lightpad to the announced address if it has changed
+func follow(lp *DefaultLightpad, la LightpadAnnouncement) {
+	if ip, port := lp.address(); !ip.Equal(la.IP) || port != la.Port {
+		logrus.WithField("lpid", la.ID).WithField("ip", la.IP).Debug("lightpad moved")
+		lp.SetAddress(la.IP, la.Port)
+	}
+}
+
+// Lightpad returns the lightpad if it has been heard from
+func (f *LightpadFactory) Lightpad(lpid string) (*DefaultLightpad, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lp, ok := f.pads[lpid]
+	return lp, ok
+}
+
+// Lightpads returns every lightpad heard from, sorted by ID
+func (f *LightpadFactory) Lightpads() []*DefaultLightpad {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lps := make([]*DefaultLightpad, 0, len(f.pads))
+	for _, lp := range f.pads {
+		lps = append(lps, lp)
+	}
+	sort.Slice(lps, func(i, j int) bool { return lps[i].ID < lps[j].ID })
+	return lps
+}
+
+// LightpadForLLID returns the first lightpad, by ID, heard from that controls
+// the logical load, so a factory can be used to run scenes with ActivateScene.
+// The error matches ErrNotFound if none of them have been heard from.
+func (f *LightpadFactory) LightpadForLLID(llid string) (LoadController, error) {
+	for _, lp := range f.Lightpads() {
+		if lp.LLID == llid {
+			return lp, nil
+		}
+	}
+	return nil, fmt.Errorf("no lightpad heard from for logical load %s: %w", llid, ErrNotFound)
+}
+
+// Unheard returns the IDs of the lightpads in the house that haven't been
+// heard from on the network, sorted
+func (f *LightpadFactory) Unheard() IDs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids IDs
+	for lpid := range f.specs {
+		if _, ok := f.pads[lpid]; !ok {
+			ids = append(ids, lpid)
+		}
+	}
+	sort.Sort(ids)
+	return ids
+}
+
+// Subscribe returns a channel of lightpads as they are first heard from, until
+// the context is done, when it is closed. Lightpads are dropped if more than
+// buffer (or DefaultRegistryBuffer if buffer is less than 1) are waiting to be
+// read; Lightpads still has them all.
+func (f *LightpadFactory) Subscribe(ctx context.Context, buffer int) <-chan *DefaultLightpad {
+	if buffer < 1 {
+		buffer = DefaultRegistryBuffer
+	}
+	ch := make(chan *DefaultLightpad, buffer)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.subs, ch)
+		close(ch)
+	}()
+	return ch
+}
@@ -0,0 +1,133 @@
+package libplumraw
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLightpadFactory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wc := newMapWebConnection()
+	house := wc.houses["house1"]
+	house.AccessToken = "hat"
+	wc.houses["house1"] = house
+
+	f, err := NewLightpadFactory(ctx, wc, "house1")
+	// the lightpad that couldn't be fetched is reported
+	pfe := &PartialFetchError{}
+	assert.True(t, errors.As(err, &pfe))
+	assert.Equal(t, "house1", f.House().ID)
+	assert.Equal(t, IDs{"pad1", "pad2", "pad3"}, f.Unheard())
+	resolved := f.Subscribe(ctx, 0)
+	f.Configure = func(lp *DefaultLightpad) { lp.Timeout = time.Second }
+
+	lp := f.Observe(LightpadAnnouncement{ID: "pad2", IP: net.ParseIP("10.0.0.2"), Port: 8443})
+	assert.Equal(t, "pad2", lp.ID)
+	assert.Equal(t, "load1", lp.LLID)
+	assert.Equal(t, "hat", lp.HAT)
+	assert.True(t, lp.IP.Equal(net.ParseIP("10.0.0.2")))
+	assert.Equal(t, 8443, lp.Port)
+	assert.Equal(t, time.Second, lp.Timeout)
+	assert.Equal(t, lp, <-resolved)
+	assert.Equal(t, IDs{"pad1", "pad3"}, f.Unheard())
+
+	// lightpads from other houses are ignored
+	assert.Nil(t, f.Observe(LightpadAnnouncement{ID: "neighbour", IP: net.ParseIP("10.0.0.9"), Port: 8443}))
+
+	// a lightpad that moves is updated in place
+	moved := f.Observe(LightpadAnnouncement{ID: "pad2", IP: net.ParseIP("10.0.0.7"), Port: 8444})
+	assert.True(t, moved == lp)
+	ip, port := lp.address()
+	assert.True(t, ip.Equal(net.ParseIP("10.0.0.7")))
+	assert.Equal(t, 8444, port)
+	select {
+	case lp := <-resolved:
+		t.Errorf("moving lightpad %s sent it again", lp.ID)
+	default:
+	}
+
+	f.Observe(LightpadAnnouncement{ID: "pad1", IP: net.ParseIP("10.0.0.1"), Port: 8443})
+	lps := f.Lightpads()
+	assert.Len(t, lps, 2)
+	assert.Equal(t, "pad1", lps[0].ID)
+	assert.Equal(t, "pad2", lps[1].ID)
+	found, ok := f.Lightpad("pad1")
+	assert.True(t, ok)
+	assert.Equal(t, lps[0], found)
+	_, ok = f.Lightpad("pad3")
+	assert.False(t, ok)
+
+	// scenes can be run through the first lightpad on each load
+	lc, err := f.LightpadForLLID("load1")
+	assert.NoError(t, err)
+	assert.Equal(t, lps[0], lc)
+	_, err = f.LightpadForLLID("load3")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	// a missing house is an outright failure
+	_, err = NewLightpadFactory(ctx, wc, "house-gone")
+	assert.Equal(t, errNoSuchThing, err)
+}
+
+func TestLightpadFactoryConfigureReentry(t *testing.T) {
+	f, _ := NewLightpadFactory(context.Background(), newMapWebConnection(), "house1")
+	var inner *DefaultLightpad
+	f.Configure = func(lp *DefaultLightpad) {
+		// the factory can be used while configuring, even to hear from the
+		// same lightpad again
+		assert.Len(t, f.Lightpads(), 0)
+		if inner == nil {
+			inner = lp
+			f.Observe(LightpadAnnouncement{ID: "pad1", IP: net.ParseIP("10.0.0.8"), Port: 8443})
+		}
+	}
+	done := make(chan *DefaultLightpad)
+	go func() {
+		done <- f.Observe(LightpadAnnouncement{ID: "pad1", IP: net.ParseIP("10.0.0.1"), Port: 8443})
+	}()
+	var lp *DefaultLightpad
+	select {
+	case lp = <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Observe deadlocked calling Configure")
+	}
+	// the lightpad that was stored first is kept, at the latest address
+	lps := f.Lightpads()
+	assert.Len(t, lps, 1)
+	assert.True(t, lp == lps[0])
+	assert.False(t, lp == inner)
+	ip, _ := lp.address()
+	assert.True(t, ip.Equal(net.ParseIP("10.0.0.1")))
+}
+
+func TestLightpadFactoryRun(t *testing.T) {
+	f, _ := NewLightpadFactory(context.Background(), newMapWebConnection(), "house1")
+	ctx, cancel := context.WithCancel(context.Background())
+	resolved := f.Subscribe(ctx, 0)
+	done := make(chan error)
+	hb := &TestLightpadHeartbeat{
+		LightpadAnnouncement: LightpadAnnouncement{ID: "pad3", IP: net.ParseIP("10.0.0.3"), Port: 8443},
+		Interval:             time.Millisecond,
+	}
+	go func() { done <- f.Run(ctx, hb) }()
+	select {
+	case lp := <-resolved:
+		assert.Equal(t, "pad3", lp.ID)
+		assert.Equal(t, "load3", lp.LLID)
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for the lightpad")
+	}
+	cancel()
+	assert.NoError(t, <-done)
+
+	// a listener that fails is reported
+	hbErr := errors.New("port in use")
+	hb.Error = &hbErr
+	assert.Equal(t, hbErr, f.Run(context.Background(), hb))
+}
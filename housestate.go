@@ -0,0 +1,350 @@
+package libplumraw
+
+// housestate.go keeps a live picture of a house by merging its config from the
+// Plum web service with the heartbeats and event streams of its lightpads.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultHouseStateBuffer is how many changes a HouseState subscriber can fall
+// behind by before more are dropped
+const DefaultHouseStateBuffer = 64
+
+// LoadState is the current state of a logical load
+type LoadState struct {
+	LLID     string
+	Name     string
+	RoomID   string
+	RoomName string
+	LPIDs    IDs
+	// Level is the load's level, 0-255, as last reported by any of its
+	// lightpads
+	Level int
+	// Watts is the power drawn by the load, summed across its lightpads
+	Watts int
+	// LastMotion is when one of its lightpads last saw motion
+	LastMotion time.Time
+	// Updated is when any of the above last changed. It is zero until the
+	// first event from one of the load's lightpads.
+	Updated time.Time
+}
+
+// LightpadState is the current state of a lightpad
+type LightpadState struct {
+	LPID string
+	LLID string
+	Name string
+	// IP and Port are where the lightpad last announced itself
+	IP   net.IP
+	Port int
+	// Reachable is true while the lightpad is sending heartbeats
+	Reachable bool
+	LastSeen  time.Time
+	// Streaming is true while the lightpad's event stream is connected
+	Streaming bool
+	Level     int
+	Watts     int
+	// LastMotion is when the lightpad last saw motion
+	LastMotion time.Time
+}
+
+// HouseSnapshot is the state of every load and lightpad in a house at one
+// moment
+type HouseSnapshot struct {
+	House House
+	// Loads and Lightpads are sorted by ID
+	Loads     []LoadState
+	Lightpads []LightpadState
+}
+
+// StateChangeKind says what changed in a HouseState
+type StateChangeKind int
+
+const (
+	// LevelChanged is a load being set to a new level
+	LevelChanged StateChangeKind = iota
+	// PowerChanged is a lightpad reporting a new wattage
+	PowerChanged
+	// MotionDetected is a lightpad seeing motion
+	MotionDetected
+	// ReachabilityChanged is a lightpad appearing, moving or going quiet on
+	// the network
+	ReachabilityChanged
+	// StreamChanged is a lightpad's event stream connecting or disconnecting
+	StreamChanged
+)
+
+func (k StateChangeKind) String() string {
+	switch k {
+	case LevelChanged:
+		return "level"
+	case PowerChanged:
+		return "power"
+	case MotionDetected:
+		return "motion"
+	case ReachabilityChanged:
+		return "reachability"
+	case StreamChanged:
+		return "stream"
+	}
+	return fmt.Sprintf("StateChangeKind(%d)", int(k))
+}
+
+// StateChange is a notification from a HouseState, with the lightpad and load
+// as they were just after the change
+type StateChange struct {
+	Kind     StateChangeKind
+	Time     time.Time
+	Load     LoadState
+	Lightpad LightpadState
+}
+
+// HouseState is a live model of one house. It starts out with the house's
+// config and is kept up to date by feeding it presence changes from a
+// Registry and events from the house's lightpads, either with Watch or with
+// ApplyPresence and ApplyEvent. It is safe to use from many goroutines.
+type HouseState struct {
+	mu    sync.RWMutex
+	house House
+	loads map[string]*LoadState
+	pads  map[string]*LightpadState
+	subs  map[chan StateChange]struct{}
+}
+
+// FetchHouseState fetches the house with FetchHouseTopology and returns its
+// state. If some of the house couldn't be fetched, the state of what could is
+// returned along with the *PartialFetchError.
+func FetchHouseState(ctx context.Context, wc WebConnection, hid string) (*HouseState, error) {
+	topo, err := FetchHouseTopology(ctx, wc, hid, 0)
+	if topo == nil {
+		return nil, err
+	}
+	return NewHouseState(topo), err
+}
+
+// NewHouseState returns the state of the house before anything has been heard
+// from its lightpads
+func NewHouseState(topo *HouseTopology) *HouseState {
+	s := &HouseState{
+		house: topo.House,
+		loads: make(map[string]*LoadState),
+		pads:  make(map[string]*LightpadState),
+		subs:  make(map[chan StateChange]struct{}),
+	}
+	for _, rt := range topo.Rooms {
+		for _, lt := range rt.LogicalLoads {
+			ls := &LoadState{
+				LLID:     lt.LogicalLoad.ID,
+				Name:     lt.LogicalLoad.Name,
+				RoomID:   rt.Room.ID,
+				RoomName: rt.Room.Name,
+			}
+			for _, spec := range lt.Lightpads {
+				ls.LPIDs = append(ls.LPIDs, spec.ID)
+				s.pads[spec.ID] = &LightpadState{
+					LPID: spec.ID,
+					LLID: ls.LLID,
+					Name: spec.Name,
+				}
+			}
+			s.loads[ls.LLID] = ls
+		}
+	}
+	return s
+}
+
+// Watch applies presence changes and events until the context is done or both
+// channels are closed. Either channel may be nil.
+func (s *HouseState) Watch(ctx context.Context, presence <-chan PresenceEvent, events <-chan Event) {
+	for presence != nil || events != nil {
+		select {
+		case pe, ok := <-presence:
+			if !ok {
+				presence = nil
+				continue
+			}
+			s.ApplyPresence(pe)
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			s.ApplyEvent(ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ApplyPresence records a lightpad appearing, moving or expiring. Lightpads
+// that aren't in the house are ignored.
+func (s *HouseState) ApplyPresence(pe PresenceEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps, ok := s.pads[pe.Lightpad.LPID]
+	if !ok {
+		return
+	}
+	ps.IP = pe.Lightpad.IP
+	ps.Port = pe.Lightpad.Port
+	ps.LastSeen = pe.Lightpad.LastSeen
+	ps.Reachable = pe.Change != PresenceExpired
+	s.notify(ReachabilityChanged, pe.Lightpad.LastSeen, ps)
+}
+
+// ApplyEvent updates the lightpad the event came from and its load. Events
+// from lightpads that aren't in the house, and kinds of event that don't
+// change the state, are ignored.
+func (s *HouseState) ApplyEvent(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps, ok := s.pads[ev.LPID()]
+	if !ok {
+		return
+	}
+	ls := s.loads[ps.LLID]
+	now := ev.Time()
+	switch e := ev.(type) {
+	case LPEDimmerChange:
+		// every lightpad on a load shows the same level
+		if ls.Level == e.Level && !ls.Updated.IsZero() {
+			return
+		}
+		ls.Level = e.Level
+		ls.Updated = now
+		for _, lpid := range ls.LPIDs {
+			s.pads[lpid].Level = e.Level
+		}
+		s.notify(LevelChanged, now, ps)
+	case LPEPower:
+		if ps.Watts == e.Watts && !ls.Updated.IsZero() {
+			return
+		}
+		ps.Watts = e.Watts
+		ls.Watts = 0
+		for _, lpid := range ls.LPIDs {
+			ls.Watts += s.pads[lpid].Watts
+		}
+		ls.Updated = now
+		s.notify(PowerChanged, now, ps)
+	case LPEPIRSignal:
+		ps.LastMotion = now
+		ls.LastMotion = now
+		ls.Updated = now
+		s.notify(MotionDetected, now, ps)
+	case LPEConnected:
+		ps.Streaming = true
+		s.notify(StreamChanged, now, ps)
+	case LPEDisconnected:
+		ps.Streaming = false
+		s.notify(StreamChanged, now, ps)
+	}
+}
+
+// House is the house's config as it was fetched
+func (s *HouseState) House() House {
+	return s.house
+}
+
+// Load returns the current state of the logical load
+func (s *HouseState) Load(llid string) (LoadState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ls, ok := s.loads[llid]
+	if !ok {
+		return LoadState{}, false
+	}
+	return copyLoadState(ls), true
+}
+
+// Lightpad returns the current state of the lightpad
+func (s *HouseState) Lightpad(lpid string) (LightpadState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ps, ok := s.pads[lpid]
+	if !ok {
+		return LightpadState{}, false
+	}
+	return copyLightpadState(ps), true
+}
+
+// Snapshot returns the state of every load and lightpad, all taken at once so
+// they agree with each other
+func (s *HouseState) Snapshot() HouseSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap := HouseSnapshot{
+		House:     s.house,
+		Loads:     make([]LoadState, 0, len(s.loads)),
+		Lightpads: make([]LightpadState, 0, len(s.pads)),
+	}
+	for _, ls := range s.loads {
+		snap.Loads = append(snap.Loads, copyLoadState(ls))
+	}
+	for _, ps := range s.pads {
+		snap.Lightpads = append(snap.Lightpads, copyLightpadState(ps))
+	}
+	sort.Slice(snap.Loads, func(i, j int) bool { return snap.Loads[i].LLID < snap.Loads[j].LLID })
+	sort.Slice(snap.Lightpads, func(i, j int) bool { return snap.Lightpads[i].LPID < snap.Lightpads[j].LPID })
+	return snap
+}
+
+// Subscribe returns a channel of changes to the house until the context is
+// done, when it is closed. Changes are dropped if more than buffer (or
+// DefaultHouseStateBuffer if buffer is less than 1) are waiting to be read.
+func (s *HouseState) Subscribe(ctx context.Context, buffer int) <-chan StateChange {
+	if buffer < 1 {
+		buffer = DefaultHouseStateBuffer
+	}
+	ch := make(chan StateChange, buffer)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subs, ch)
+		close(ch)
+	}()
+	return ch
+}
+
+// notify tells every subscriber with room for it about a change to the
+// lightpad. s.mu must be held.
+func (s *HouseState) notify(kind StateChangeKind, t time.Time, ps *LightpadState) {
+	if len(s.subs) == 0 {
+		return
+	}
+	sc := StateChange{
+		Kind:     kind,
+		Time:     t,
+		Load:     copyLoadState(s.loads[ps.LLID]),
+		Lightpad: copyLightpadState(ps),
+	}
+	for ch := range s.subs {
+		select {
+		case ch <- sc:
+		default:
+		}
+	}
+}
+
+// copyLoadState copies the load so callers can't change it under the lock
+func copyLoadState(ls *LoadState) LoadState {
+	c := *ls
+	c.LPIDs = append(IDs(nil), ls.LPIDs...)
+	return c
+}
+
+func copyLightpadState(ps *LightpadState) LightpadState {
+	c := *ps
+	c.IP = append(net.IP(nil), ps.IP...)
+	return c
+}
@@ -0,0 +1,150 @@
+package libplumraw
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stateEvent makes an event as if it came from the lightpad's stream
+func stateEvent(ev Event, lpid, llid string, t time.Time) Event {
+	base := LightpadEvent{LightpadID: lpid, LogicalLoadID: llid, Received: t}
+	switch e := ev.(type) {
+	case LPEDimmerChange:
+		e.LightpadEvent = base
+		return e
+	case LPEPower:
+		e.LightpadEvent = base
+		return e
+	case LPEPIRSignal:
+		e.LightpadEvent = base
+		return e
+	case LPEConnected:
+		e.LightpadEvent = base
+		return e
+	}
+	return ev
+}
+
+func nextChange(t *testing.T, ch <-chan StateChange) StateChange {
+	t.Helper()
+	select {
+	case sc := <-ch:
+		return sc
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a state change")
+	}
+	return StateChange{}
+}
+
+func TestHouseState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wc := newMapWebConnection()
+	s, err := FetchHouseState(ctx, wc, "house1")
+	assert.Error(t, err)
+	changes := s.Subscribe(ctx, 0)
+	t0 := time.Unix(1500000000, 0)
+
+	ls, ok := s.Load("load1")
+	assert.True(t, ok)
+	assert.Equal(t, LoadState{LLID: "load1", RoomID: "room1", LPIDs: IDs{"pad1", "pad2"}}, ls)
+	_, ok = s.Lightpad("pad-gone")
+	assert.False(t, ok)
+
+	s.ApplyPresence(PresenceEvent{
+		Change:   PresenceAdded,
+		Lightpad: LightpadPresence{LPID: "pad1", IP: net.ParseIP("10.0.0.1"), Port: 8443, LastSeen: t0},
+	})
+	sc := nextChange(t, changes)
+	assert.Equal(t, ReachabilityChanged, sc.Kind)
+	assert.True(t, sc.Lightpad.Reachable)
+	assert.Equal(t, 8443, sc.Lightpad.Port)
+
+	// a level change on one lightpad shows on every lightpad on the load
+	s.ApplyEvent(stateEvent(LPEDimmerChange{Level: 128}, "pad1", "load1", t0))
+	sc = nextChange(t, changes)
+	assert.Equal(t, LevelChanged, sc.Kind)
+	assert.Equal(t, 128, sc.Load.Level)
+	ps, _ := s.Lightpad("pad2")
+	assert.Equal(t, 128, ps.Level)
+	// the same level again isn't a change
+	s.ApplyEvent(stateEvent(LPEDimmerChange{Level: 128}, "pad2", "load1", t0))
+
+	// power adds up across the lightpads on a load
+	s.ApplyEvent(stateEvent(LPEPower{Watts: 30}, "pad1", "load1", t0))
+	s.ApplyEvent(stateEvent(LPEPower{Watts: 5}, "pad2", "load1", t0))
+	assert.Equal(t, PowerChanged, nextChange(t, changes).Kind)
+	sc = nextChange(t, changes)
+	assert.Equal(t, PowerChanged, sc.Kind)
+	assert.Equal(t, 35, sc.Load.Watts)
+	assert.Equal(t, 5, sc.Lightpad.Watts)
+
+	t1 := t0.Add(time.Minute)
+	s.ApplyEvent(stateEvent(LPEPIRSignal{Signal: 40}, "pad2", "load1", t1))
+	sc = nextChange(t, changes)
+	assert.Equal(t, MotionDetected, sc.Kind)
+	assert.Equal(t, t1, sc.Load.LastMotion)
+	assert.Equal(t, t1, sc.Lightpad.LastMotion)
+
+	s.ApplyEvent(stateEvent(LPEConnected{}, "pad3", "load3", t1))
+	sc = nextChange(t, changes)
+	assert.Equal(t, StreamChanged, sc.Kind)
+	assert.True(t, sc.Lightpad.Streaming)
+
+	// lightpads that aren't in the house are ignored
+	s.ApplyEvent(stateEvent(LPEDimmerChange{Level: 1}, "neighbour", "load1", t1))
+	s.ApplyPresence(PresenceEvent{Change: PresenceAdded, Lightpad: LightpadPresence{LPID: "neighbour"}})
+
+	s.ApplyPresence(PresenceEvent{
+		Change:   PresenceExpired,
+		Lightpad: LightpadPresence{LPID: "pad1", IP: net.ParseIP("10.0.0.1"), Port: 8443, LastSeen: t0},
+	})
+	sc = nextChange(t, changes)
+	assert.Equal(t, ReachabilityChanged, sc.Kind)
+	assert.False(t, sc.Lightpad.Reachable)
+	select {
+	case sc := <-changes:
+		t.Errorf("unexpected %s change", sc.Kind)
+	default:
+	}
+
+	snap := s.Snapshot()
+	assert.Equal(t, "house1", snap.House.ID)
+	assert.Len(t, snap.Loads, 3)
+	assert.Len(t, snap.Lightpads, 3)
+	assert.Equal(t, "load1", snap.Loads[0].LLID)
+	assert.Equal(t, 35, snap.Loads[0].Watts)
+	assert.Equal(t, "pad1", snap.Lightpads[0].LPID)
+	// snapshots are copies
+	snap.Loads[0].LPIDs[0] = "changed"
+	ls, _ = s.Load("load1")
+	assert.Equal(t, IDs{"pad1", "pad2"}, ls.LPIDs)
+
+	assert.Equal(t, "motion", MotionDetected.String())
+}
+
+func TestHouseStateWatch(t *testing.T) {
+	wc := newMapWebConnection()
+	s, _ := FetchHouseState(context.Background(), wc, "house1")
+	presence := make(chan PresenceEvent)
+	events := make(chan Event)
+	done := make(chan struct{})
+	go func() {
+		s.Watch(context.Background(), presence, events)
+		close(done)
+	}()
+	presence <- PresenceEvent{Change: PresenceAdded, Lightpad: LightpadPresence{LPID: "pad3"}}
+	events <- stateEvent(LPEDimmerChange{Level: 200}, "pad3", "load3", time.Now())
+	close(presence)
+	close(events)
+	<-done
+
+	ps, ok := s.Lightpad("pad3")
+	assert.True(t, ok)
+	assert.True(t, ps.Reachable)
+	assert.Equal(t, 200, ps.Level)
+}
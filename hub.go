@@ -0,0 +1,271 @@
+package libplumraw
+
+// hub.go shares the event streams of many lightpads among any number of
+// subscribers, so each switch only needs one connection.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultHubBuffer is how many events a hub subscription holds when
+// Subscribe isn't given a size
+const DefaultHubBuffer = 64
+
+// ErrHubClosed is returned when adding lightpads to a Hub that's been closed
+var ErrHubClosed = errors.New("hub is closed")
+
+// EventFilter picks which events a Hub subscription gets. Each list that isn't
+// empty must contain the event's value; empty lists match everything.
+type EventFilter struct {
+	LPIDs   []string
+	LLIDs   []string
+	RoomIDs []string
+	Kinds   []LightpadEventType
+}
+
+// Match is true if the event, from a load in the given room, passes the filter
+func (f EventFilter) Match(ev Event, rid string) bool {
+	return matchString(f.LPIDs, ev.LPID()) &&
+		matchString(f.LLIDs, ev.LLID()) &&
+		matchString(f.RoomIDs, rid) &&
+		matchKind(f.Kinds, ev.Kind())
+}
+
+func matchString(want []string, have string) bool {
+	if len(want) == 0 {
+		return true
+	}
+	for _, w := range want {
+		if w == have {
+			return true
+		}
+	}
+	return false
+}
+
+func matchKind(want []LightpadEventType, have LightpadEventType) bool {
+	if len(want) == 0 {
+		return true
+	}
+	for _, w := range want {
+		if w == have {
+			return true
+		}
+	}
+	return false
+}
+
+// Hub subscribes to the event streams of many lightpads and hands each event
+// to every HubSubscription whose filter it matches. Subscribers that fall
+// behind lose events rather than holding up the others; see
+// HubSubscription.Dropped.
+type Hub struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// mu is held for reading while events are handed out and for writing
+	// while subscriptions are closed, so nothing is sent on a closed channel
+	mu     sync.RWMutex
+	closed bool
+	pads   map[string]*hubPad
+	rooms  map[string]string
+	subs   map[*HubSubscription]struct{}
+}
+
+type hubPad struct {
+	cancel context.CancelFunc
+}
+
+// HubSubscription receives the events that match its filter
+type HubSubscription struct {
+	hub    *Hub
+	filter EventFilter
+	events chan Event
+
+	delivered uint64
+	dropped   uint64
+}
+
+// NewHub returns an empty Hub. Close it when done to disconnect from every
+// lightpad.
+func NewHub() *Hub {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Hub{
+		ctx:    ctx,
+		cancel: cancel,
+		pads:   make(map[string]*hubPad),
+		rooms:  make(map[string]string),
+		subs:   make(map[*HubSubscription]struct{}),
+	}
+}
+
+// AddLightpad subscribes to the lightpad's events and shares them with the
+// hub's subscribers. lpid names the lightpad for RemoveLightpad. If the first
+// connection fails the error is returned and the lightpad isn't added.
+func (h *Hub) AddLightpad(lpid string, pad Lightpad) error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return ErrHubClosed
+	}
+	if _, ok := h.pads[lpid]; ok {
+		h.mu.Unlock()
+		return fmt.Errorf("lightpad %s is already in the hub", lpid)
+	}
+	ctx, cancel := context.WithCancel(h.ctx)
+	hp := &hubPad{cancel: cancel}
+	h.pads[lpid] = hp
+	// counted before letting go of the lock so Close waits for it
+	h.wg.Add(1)
+	h.mu.Unlock()
+
+	events, err := pad.Subscribe(ctx)
+	if err != nil {
+		h.wg.Done()
+		cancel()
+		h.mu.Lock()
+		if h.pads[lpid] == hp {
+			delete(h.pads, lpid)
+		}
+		h.mu.Unlock()
+		return err
+	}
+	go func() {
+		defer h.wg.Done()
+		for ev := range events {
+			h.publish(ev)
+		}
+		logrus.WithField("lpid", lpid).Debug("hub stopped receiving from lightpad")
+		h.mu.Lock()
+		if h.pads[lpid] == hp {
+			delete(h.pads, lpid)
+		}
+		h.mu.Unlock()
+		cancel()
+	}()
+	return nil
+}
+
+// RemoveLightpad disconnects from the lightpad. Events it already sent may
+// still be delivered.
+func (h *Hub) RemoveLightpad(lpid string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hp, ok := h.pads[lpid]; ok {
+		hp.cancel()
+		delete(h.pads, lpid)
+	}
+}
+
+// Lightpads returns the LPIDs of the lightpads the hub is connected to, sorted
+func (h *Hub) Lightpads() IDs {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	lpids := make(IDs, 0, len(h.pads))
+	for lpid := range h.pads {
+		lpids = append(lpids, lpid)
+	}
+	sort.Sort(lpids)
+	return lpids
+}
+
+// SetRoom records which room a logical load is in, for filtering by room
+func (h *Hub) SetRoom(llid, rid string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rooms[llid] = rid
+}
+
+// Subscribe registers for the events that match filter. buffer is how many
+// events can wait to be read before more are dropped; less than 1 means
+// DefaultHubBuffer. The subscription's channel is closed by its Close or the
+// hub's.
+func (h *Hub) Subscribe(filter EventFilter, buffer int) *HubSubscription {
+	if buffer < 1 {
+		buffer = DefaultHubBuffer
+	}
+	s := &HubSubscription{
+		hub:    h,
+		filter: filter,
+		events: make(chan Event, buffer),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(s.events)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+// Close disconnects from every lightpad and closes every subscription
+func (h *Hub) Close() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	h.cancel()
+	h.mu.Unlock()
+	h.wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		close(s.events)
+		delete(h.subs, s)
+	}
+}
+
+func (h *Hub) publish(ev Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	rid := h.rooms[ev.LLID()]
+	for s := range h.subs {
+		if !s.filter.Match(ev, rid) {
+			continue
+		}
+		select {
+		case s.events <- ev:
+			atomic.AddUint64(&s.delivered, 1)
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Events is the channel on which matching events arrive
+func (s *HubSubscription) Events() <-chan Event {
+	return s.events
+}
+
+// Delivered counts the events put on the channel
+func (s *HubSubscription) Delivered() uint64 {
+	return atomic.LoadUint64(&s.delivered)
+}
+
+// Dropped counts the matching events lost because the channel was full
+func (s *HubSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops the subscription and closes its channel
+func (s *HubSubscription) Close() {
+	h := s.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
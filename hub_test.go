@@ -0,0 +1,112 @@
+package libplumraw
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func hubEvent(lpid, llid string, ev Event) Event {
+	base := LightpadEvent{LightpadID: lpid, LogicalLoadID: llid}
+	switch e := ev.(type) {
+	case LPEDimmerChange:
+		e.LightpadEvent = base
+		return e
+	case LPEPower:
+		e.LightpadEvent = base
+		return e
+	case LPEPIRSignal:
+		e.LightpadEvent = base
+		return e
+	}
+	return ev
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	defer hub.Close()
+	hub.SetRoom("load1", "kitchen")
+	hub.SetRoom("load2", "hall")
+
+	all := hub.Subscribe(EventFilter{}, 0)
+	kitchen := hub.Subscribe(EventFilter{RoomIDs: []string{"kitchen"}}, 0)
+	motion := hub.Subscribe(EventFilter{Kinds: []LightpadEventType{PIRSignal}}, 0)
+	pad2 := hub.Subscribe(EventFilter{LPIDs: []string{"pad2"}, LLIDs: []string{"load2"}}, 0)
+	// a slow reader with room for one event
+	slow := hub.Subscribe(EventFilter{}, 1)
+
+	err := hub.AddLightpad("pad1", &TestLightpad{Events: []Event{
+		hubEvent("pad1", "load1", LPEDimmerChange{Level: 10}),
+		hubEvent("pad1", "load1", LPEPIRSignal{Signal: 1}),
+	}})
+	assert.NoError(t, err)
+	err = hub.AddLightpad("pad2", &TestLightpad{Events: []Event{
+		hubEvent("pad2", "load2", LPEPower{Watts: 40}),
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, IDs{"pad1", "pad2"}, hub.Lightpads())
+
+	// the same lightpad can't be added twice
+	err = hub.AddLightpad("pad1", &TestLightpad{})
+	assert.Error(t, err)
+
+	assert.Eventually(t, func() bool {
+		return all.Delivered() == 3
+	}, time.Second, time.Millisecond)
+	assert.Len(t, drain(all), 3)
+	assert.Equal(t, []LightpadEventType{DimmerChange, PIRSignal}, kinds(drain(kitchen)))
+	assert.Equal(t, []LightpadEventType{PIRSignal}, kinds(drain(motion)))
+	assert.Equal(t, []LightpadEventType{Power}, kinds(drain(pad2)))
+	assert.Equal(t, uint64(1), slow.Delivered())
+	assert.Equal(t, uint64(2), slow.Dropped())
+	assert.Equal(t, uint64(0), all.Dropped())
+
+	// a closed subscription gets nothing more
+	kitchen.Close()
+	_, open := <-kitchen.Events()
+	assert.False(t, open)
+	kitchen.Close()
+
+	hub.RemoveLightpad("pad1")
+	assert.Equal(t, IDs{"pad2"}, hub.Lightpads())
+}
+
+func TestHubAddFails(t *testing.T) {
+	hub := NewHub()
+	padErr := errors.New("unreachable")
+	err := hub.AddLightpad("pad1", &TestLightpad{Error: &padErr})
+	assert.Equal(t, padErr, err)
+	assert.Empty(t, hub.Lightpads())
+
+	sub := hub.Subscribe(EventFilter{}, 0)
+	hub.Close()
+	_, open := <-sub.Events()
+	assert.False(t, open)
+	assert.Equal(t, ErrHubClosed, hub.AddLightpad("pad1", &TestLightpad{}))
+	// subscribing after close gets a closed channel
+	_, open = <-hub.Subscribe(EventFilter{}, 0).Events()
+	assert.False(t, open)
+	hub.Close()
+}
+
+func drain(s *HubSubscription) []Event {
+	var evs []Event
+	for {
+		select {
+		case ev := <-s.Events():
+			evs = append(evs, ev)
+		default:
+			return evs
+		}
+	}
+}
+
+func kinds(evs []Event) []LightpadEventType {
+	var ks []LightpadEventType
+	for _, ev := range evs {
+		ks = append(ks, ev.Kind())
+	}
+	return ks
+}
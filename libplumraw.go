@@ -2,6 +2,7 @@ package libplumraw
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
 	"time"
 )
@@ -17,6 +18,12 @@ const (
 	DefaultUserAgent             = "libplumraw"
 	DefaultPlumAPIHOST           = "https://production.plum.technology"
 
+	// DefaultLightpadTimeout bounds each call to a lightpad whose Timeout is
+	// unset so an unreachable switch can't block forever.
+	DefaultLightpadTimeout = 5 * time.Second
+	// DefaultLightpadStreamPort is the port on which lightpads send events
+	DefaultLightpadStreamPort = 2708
+
 	// website API paths
 	pathGetHouses      = "/v2/getHouses"
 	pathGetHouse       = "/v2/getHouse"
@@ -26,6 +33,13 @@ const (
 	pathGetLogicalLoad = "/v2/getLogicalLoad"
 	pathGetLightpad    = "/v2/getLightpad"
 
+	pathCreateScene       = "/v2/createScene"
+	pathUpdateScene       = "/v2/updateScene"
+	pathDeleteScene       = "/v2/deleteScene"
+	pathRenameRoom        = "/v2/renameRoom"
+	pathRenameLogicalLoad = "/v2/renameLogicalLoad"
+	pathRenameLightpad    = "/v2/renameLightpad"
+
 	// lightpad API paths
 	pathSetLogicalLoadLevel   = "/v2/setLogicalLoadLevel"
 	pathSetLogicalLoadConfig  = "/v2/setLogicalLoadConfig"
@@ -35,33 +49,69 @@ const (
 
 var UserAgentAddition string
 
-// Use this for lightpads but not web connections
-// var lightpadHttpClient = &http.Client{Transport: &http.Transport{
-// 	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-// }}
+// lightpadHttpClient is used by lightpads with no HttpClient of their own,
+// but not by web connections. Lightpads serve a self-signed certificate.
+var lightpadHttpClient = &http.Client{Transport: &http.Transport{
+	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+}}
 
+// WebConnection is the set of calls that can be made to the Plum web service.
+// Every call takes a context; cancelling it or letting its deadline pass
+// aborts any request that is in flight.
 type WebConnection interface {
-	GetHouses() (Houses, error)
-	GetHouse(string) (House, error)
-	GetScenes(string) (Scenes, error)
-	GetScene(string) (Scene, error)
-	GetRoom(string) (Room, error)
-	GetLogicalLoad(string) (LogicalLoad, error)
-	GetLightpad(string) (LightpadSpec, error)
+	GetHouses(context.Context) (Houses, error)
+	GetHouse(context.Context, string) (House, error)
+	GetScenes(context.Context, string) (Scenes, error)
+	GetScene(context.Context, string) (Scene, error)
+	GetRoom(context.Context, string) (Room, error)
+	GetLogicalLoad(context.Context, string) (LogicalLoad, error)
+	GetLightpad(context.Context, string) (LightpadSpec, error)
+
+	CreateScene(context.Context, Scene) (Scene, error)
+	UpdateScene(context.Context, Scene) error
+	DeleteScene(context.Context, string) error
+	RenameRoom(ctx context.Context, rid, name string) error
+	RenameLogicalLoad(ctx context.Context, llid, name string) error
+	RenameLightpad(ctx context.Context, lpid, name string) error
 }
 
+// Lightpad is the set of calls that can be made directly to a switch. Calls
+// are abandoned when the context passed in is cancelled or its deadline
+// passes.
+//
+// Subscribe returns a channel of the events the switch reports. The channel is
+// closed once the context is done, or earlier if the subscription can't
+// continue; it is never closed while events are still being sent. Each call
+// to Subscribe gets its own channel.
 type Lightpad interface {
-	SetLogicalLoadLevel(level int) error
-	SetLogicalLoadConfig(conf LogicalLoadConfig) error
-	GetLogicalLoadMetrics() (LogicalLoadMetrics, error)
-	SetLogicalLoadGlow(glow ForceGlow) error
-	Subscribe(context.Context) (chan Event, error)
+	SetLogicalLoadLevel(ctx context.Context, level int) error
+	SetLogicalLoadConfig(ctx context.Context, conf LogicalLoadConfig) error
+	SetLightpadConfig(ctx context.Context, conf LightpadConfig) error
+	GetLogicalLoadMetrics(ctx context.Context) (LogicalLoadMetrics, error)
+	SetLogicalLoadGlow(ctx context.Context, glow ForceGlow) error
+	Subscribe(context.Context) (<-chan Event, error)
 }
 
+// HeartbeatListener reports the heartbeats lightpads broadcast to announce
+// where they can be reached. The channel is closed once the context is done.
+type HeartbeatListener interface {
+	Listen(context.Context) (<-chan LightpadAnnouncement, error)
+}
+
+var (
+	_ Lightpad          = (*DefaultLightpad)(nil)
+	_ Lightpad          = (*TestLightpad)(nil)
+	_ HeartbeatListener = (*DefaultLightpadHeartbeat)(nil)
+	_ HeartbeatListener = (*TestLightpadHeartbeat)(nil)
+	_ LightpadResolver  = (*LightpadFactory)(nil)
+)
+
 type WebConnectionConfig struct {
 	Email      string
 	Password   string
 	PlumAPIURL string // default https://production.plum.technology/
+	// Retry, if set, retries calls that fail with a transient error
+	Retry *RetryPolicy
 }
 
 type defaultWebConnection struct {
@@ -99,104 +149,191 @@ func NewTestWebConnection() *TestWebConnection {
 	return &TestWebConnection{}
 }
 
-func (t *TestWebConnection) GetHouses() (Houses, error) {
+// err returns the context's error if it is already done, otherwise the error
+// with which the TestWebConnection was configured
+func (t *TestWebConnection) err(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if t.Error != nil {
-		return nil, *t.Error
+		return *t.Error
+	}
+	return nil
+}
+
+func (t *TestWebConnection) GetHouses(ctx context.Context) (Houses, error) {
+	if err := t.err(ctx); err != nil {
+		return nil, err
 	}
 	return t.Houses, nil
 }
 
-func (t *TestWebConnection) GetHouse(hid string) (House, error) {
-	if t.Error != nil {
-		return House{}, *t.Error
+func (t *TestWebConnection) GetHouse(ctx context.Context, hid string) (House, error) {
+	if err := t.err(ctx); err != nil {
+		return House{}, err
 	}
 	return t.House, nil
 }
 
-func (t *TestWebConnection) GetScenes(hid string) (Scenes, error) {
-	if t.Error != nil {
-		return nil, *t.Error
+func (t *TestWebConnection) GetScenes(ctx context.Context, hid string) (Scenes, error) {
+	if err := t.err(ctx); err != nil {
+		return nil, err
 	}
 	return t.Scenes, nil
 }
 
-func (t *TestWebConnection) GetScene(hid string) (Scene, error) {
-	if t.Error != nil {
-		return Scene{}, *t.Error
+func (t *TestWebConnection) GetScene(ctx context.Context, sid string) (Scene, error) {
+	if err := t.err(ctx); err != nil {
+		return Scene{}, err
 	}
 	return t.Scene, nil
 }
 
-func (t *TestWebConnection) GetRoom(rid string) (Room, error) {
-	if t.Error != nil {
-		return Room{}, *t.Error
+func (t *TestWebConnection) GetRoom(ctx context.Context, rid string) (Room, error) {
+	if err := t.err(ctx); err != nil {
+		return Room{}, err
 	}
 	return t.Room, nil
 }
 
-func (t *TestWebConnection) GetLogicalLoad(llid string) (LogicalLoad, error) {
-	if t.Error != nil {
-		return LogicalLoad{}, *t.Error
+func (t *TestWebConnection) GetLogicalLoad(ctx context.Context, llid string) (LogicalLoad, error) {
+	if err := t.err(ctx); err != nil {
+		return LogicalLoad{}, err
 	}
 	return t.LogicalLoad, nil
 }
 
-func (t *TestWebConnection) GetLightpad(lpid string) (LightpadSpec, error) {
-	if t.Error != nil {
-		return LightpadSpec{}, *t.Error
+func (t *TestWebConnection) GetLightpad(ctx context.Context, lpid string) (LightpadSpec, error) {
+	if err := t.err(ctx); err != nil {
+		return LightpadSpec{}, err
 	}
 	return t.LightpadSpec, nil
 }
 
+// CreateScene returns the scene it was given. If the scene has no ID, it gets
+// the ID of the Scene with which the TestWebConnection was configured.
+func (t *TestWebConnection) CreateScene(ctx context.Context, scene Scene) (Scene, error) {
+	if err := t.err(ctx); err != nil {
+		return Scene{}, err
+	}
+	if scene.ID == "" {
+		scene.ID = t.Scene.ID
+	}
+	return scene, nil
+}
+
+func (t *TestWebConnection) UpdateScene(ctx context.Context, scene Scene) error {
+	return t.err(ctx)
+}
+
+func (t *TestWebConnection) DeleteScene(ctx context.Context, sid string) error {
+	return t.err(ctx)
+}
+
+func (t *TestWebConnection) RenameRoom(ctx context.Context, rid, name string) error {
+	return t.err(ctx)
+}
+
+func (t *TestWebConnection) RenameLogicalLoad(ctx context.Context, llid, name string) error {
+	return t.err(ctx)
+}
+
+func (t *TestWebConnection) RenameLightpad(ctx context.Context, lpid, name string) error {
+	return t.err(ctx)
+}
+
 // TestLightpad implements the Lightpad interface and is for using this library
 // in upstream tests - instead of calling out to an actual lightpad it just
 // returns the error or objects with which it was configured
 type TestLightpad struct {
 	LogicalLoadMetrics LogicalLoadMetrics
-	Error              *error
+	// Events are sent in order to each subscriber, after which the channel
+	// stays open until the subscriber's context is done
+	Events []Event
+	Error  *error
 }
 
-func (t *TestLightpad) SetLogicalLoadLevel(level int) error {
-	if t.Error != nil {
-		return *t.Error
+// err returns the context's error if it is already done, otherwise the error
+// with which the TestLightpad was configured
+func (t *TestLightpad) err(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	return nil
-}
-func (t *TestLightpad) SetLogicalLoadConfig(conf LogicalLoadConfig) error {
 	if t.Error != nil {
 		return *t.Error
 	}
 	return nil
 }
-func (t *TestLightpad) GetLogicalLoadMetrics() (LogicalLoadMetrics, error) {
-	if t.Error != nil {
-		return LogicalLoadMetrics{}, *t.Error
+
+func (t *TestLightpad) SetLogicalLoadLevel(ctx context.Context, level int) error {
+	return t.err(ctx)
+}
+func (t *TestLightpad) SetLogicalLoadConfig(ctx context.Context, conf LogicalLoadConfig) error {
+	return t.err(ctx)
+}
+func (t *TestLightpad) SetLightpadConfig(ctx context.Context, conf LightpadConfig) error {
+	return t.err(ctx)
+}
+func (t *TestLightpad) GetLogicalLoadMetrics(ctx context.Context) (LogicalLoadMetrics, error) {
+	if err := t.err(ctx); err != nil {
+		return LogicalLoadMetrics{}, err
 	}
 	return t.LogicalLoadMetrics, nil
 }
-func (t *TestLightpad) SetLogicalLoadGlow(glow ForceGlow) error {
-	if t.Error != nil {
-		return *t.Error
+func (t *TestLightpad) SetLogicalLoadGlow(ctx context.Context, glow ForceGlow) error {
+	return t.err(ctx)
+}
+func (t *TestLightpad) Subscribe(ctx context.Context) (<-chan Event, error) {
+	if err := t.err(ctx); err != nil {
+		return nil, err
 	}
-	return nil
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for _, ev := range t.Events {
+			if !sendEvent(ctx, events, ev) {
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return events, nil
 }
 
-// TestLightpadHeartbeat sends a lightpad announcement every 2 seconds until the
-// context used to intitialize it is cancelled.
+// TestLightpadHeartbeat implements HeartbeatListener. It sends its lightpad
+// announcement every Interval (2 seconds if unset) until the context passed
+// to Listen is cancelled, or returns Error from Listen if that's set.
 type TestLightpadHeartbeat struct {
 	LightpadAnnouncement
+	Interval time.Duration
+	Error    *error
 }
 
-func (t *TestLightpadHeartbeat) Listen(ctx context.Context) chan LightpadAnnouncement {
-	responses := make(chan LightpadAnnouncement, 0)
-	tick := time.NewTicker(2 * time.Second).C
+func (t *TestLightpadHeartbeat) Listen(ctx context.Context) (<-chan LightpadAnnouncement, error) {
+	if t.Error != nil {
+		return nil, *t.Error
+	}
+	interval := t.Interval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	responses := make(chan LightpadAnnouncement)
 	go func() {
-		select {
-		case <-ctx.Done():
-			return
-		case <-tick:
-			responses <- t.LightpadAnnouncement
+		defer close(responses)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case responses <- t.LightpadAnnouncement:
+			}
 		}
 	}()
-	return responses
+	return responses, nil
 }
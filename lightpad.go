@@ -1,115 +1,97 @@
 package libplumraw
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
 )
 
 // SetLogicalLoadLevel is used to both toggle and dim switches
-func (l *DefaultLightpad) SetLogicalLoadLevel(level int) error {
+func (l *DefaultLightpad) SetLogicalLoadLevel(ctx context.Context, level int) error {
 	pd := struct {
 		Level int    `json:"level"`
 		LLID  string `json:"llid"`
 	}{level, l.LLID}
-	fmt.Printf("%+v\n", pd)
-	resp, err := l.makePadPOSTRequest(pathSetLogicalLoadLevel, pd)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("failed to set load level: status %s", resp.Status)
-	}
-	return nil
+	return l.post(ctx, pathSetLogicalLoadLevel, pd, nil)
 }
 
 // SetLogicalLoadConfig
-func (l *DefaultLightpad) SetLogicalLoadConfig(conf LogicalLoadConfig) error {
+func (l *DefaultLightpad) SetLogicalLoadConfig(ctx context.Context, conf LogicalLoadConfig) error {
 	pd := struct {
 		Config LogicalLoadConfig `json:"config"`
 		LLID   string            `json:"llid"`
 	}{conf, l.LLID}
-	resp, err := l.makePadPOSTRequest(pathSetLogicalLoadConfig, pd)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("failed to set load config: status %s", resp.Status)
-	}
-	return nil
+	return l.post(ctx, pathSetLogicalLoadConfig, pd, nil)
 }
 
 // SetLightpadConfig
-func (l *DefaultLightpad) SetLightpadConfig(conf LightpadConfig) error {
+func (l *DefaultLightpad) SetLightpadConfig(ctx context.Context, conf LightpadConfig) error {
 	pd := struct {
 		Config LightpadConfig `json:"config"`
 		LLID   string         `json:"llid"`
 	}{conf, l.LLID}
-	resp, err := l.makePadPOSTRequest(pathSetLogicalLoadConfig, pd)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("failed to set pad config level: status %s", resp.Status)
-	}
-	return nil
-
+	return l.post(ctx, pathSetLogicalLoadConfig, pd, nil)
 }
 
-func (l *DefaultLightpad) GetLogicalLoadMetrics() (LogicalLoadMetrics, error) {
+func (l *DefaultLightpad) GetLogicalLoadMetrics(ctx context.Context) (LogicalLoadMetrics, error) {
 	pd := struct {
 		LLID string `json:"llid"`
 	}{
 		LLID: l.LLID,
 	}
-	resp, err := l.makePadPOSTRequest(pathGetLogicalLoadMetrics, pd)
-	if err != nil {
-		return LogicalLoadMetrics{}, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return LogicalLoadMetrics{}, fmt.Errorf("failed to get load metrics level: status %s", resp.Status)
-	}
 	lm := LogicalLoadMetrics{}
-	err = json.NewDecoder(resp.Body).Decode(&lm)
+	err := l.post(ctx, pathGetLogicalLoadMetrics, pd, &lm)
 	if err != nil {
 		return LogicalLoadMetrics{}, err
 	}
 	return lm, nil
 }
 
-func (l *DefaultLightpad) SetLogicalLoadGlow(glow ForceGlow) error {
-	resp, err := l.makePadPOSTRequest(pathSetLogicalLoadGlow, glow)
-	if err != nil {
-		return err
-	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("failed to set load glow: status %s", resp.Status)
-	}
-	return nil
+func (l *DefaultLightpad) SetLogicalLoadGlow(ctx context.Context, glow ForceGlow) error {
+	return l.post(ctx, pathSetLogicalLoadGlow, glow, nil)
+}
+
+// post makes a call to the lightpad, retrying it according to the lightpad's
+// Retry policy, with each attempt bounded by its Timeout. If out is nil the
+// lightpad is expected to reply 204 No Content, otherwise 200 OK with a body
+// that is decoded into out.
+func (l *DefaultLightpad) post(ctx context.Context, urlPath string, postData, out interface{}) error {
+	return l.Retry.do(ctx, true, func(ctx context.Context) error {
+		ctx, cancel := l.withTimeout(ctx)
+		defer cancel()
+		resp, err := l.makePadPOSTRequest(ctx, urlPath, postData)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if out == nil {
+			return checkResponse(resp, urlPath, l.LLID, http.StatusNoContent)
+		}
+		err = checkResponse(resp, urlPath, l.LLID, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		return decodeResponse(resp, urlPath, l.LLID, out)
+	})
 }
 
-func (l *DefaultLightpad) makePadPOSTRequest(urlPath string, postData interface{}) (*http.Response, error) {
+func (l *DefaultLightpad) makePadPOSTRequest(ctx context.Context, urlPath string, postData interface{}) (*http.Response, error) {
 	userAgent := fmt.Sprintf("%s/%s", DefaultUserAgent, Version)
 	if UserAgentAddition != "" {
 		userAgent = fmt.Sprintf("%s %s", userAgent, strings.TrimSpace(UserAgentAddition))
 	}
-	api, err := url.Parse(fmt.Sprintf("https://%s:%d", l.IP, l.Port))
+	ip, port := l.address()
+	api, err := url.Parse(fmt.Sprintf("https://%s", net.JoinHostPort(ip.String(), strconv.Itoa(port))))
 	if err != nil {
 		return nil, err
 	}
@@ -118,7 +100,7 @@ func (l *DefaultLightpad) makePadPOSTRequest(urlPath string, postData interface{
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", api.String(), bytes.NewReader(pd))
+	req, err := http.NewRequestWithContext(ctx, "POST", api.String(), bytes.NewReader(pd))
 	if err != nil {
 		return nil, err
 	}
@@ -127,84 +109,54 @@ func (l *DefaultLightpad) makePadPOSTRequest(urlPath string, postData interface{
 	// sha256sum the HAT for the header
 	encHat := fmt.Sprintf("%x", sha256.Sum256([]byte(l.HAT)))
 	req.Header.Set("X-Plum-House-Access-Token", encHat)
-	if l.HttpClient == nil {
-		l.HttpClient = &http.Client{Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}}
+	client := l.HttpClient
+	if client == nil {
+		client = lightpadHttpClient
 	}
-	return l.HttpClient.Do(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, &RequestError{Path: urlPath, ID: l.LLID, Err: err}
+	}
+	return resp, nil
 }
 
-// Subscribe returns a channel that will send you state changes from the
-// lightpad. When you want to close the connection and are done listening for
-// state changes on the lightpad, cancel the context passed in and it will clean
-// itself up.
-func (l *DefaultLightpad) Subscribe(ctx context.Context) error {
-	logrus.WithField("ipaddr", l.IP).Debug("about to connect to lightpad")
-	if l.StateChanges == nil {
-		l.StateChanges = make(chan Event, 5)
-	}
-	addrStr := fmt.Sprintf("%s:%d", l.IP, 2708)
-	conn, err := net.Dial("tcp", addrStr)
+// withTimeout bounds the context by the lightpad's Timeout (or
+// DefaultLightpadTimeout if it is unset). A deadline already on the context
+// that is sooner than the timeout is left in place.
+func (l *DefaultLightpad) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = DefaultLightpadTimeout
+	}
+	if timeout < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Subscribe connects to the lightpad's event stream and returns a channel of
+// the state changes it reports. An LPEConnected event is sent each time the
+// stream connects. If the connection drops, for example because the lightpad
+// rebooted, an LPEDisconnected event is sent and Subscribe reconnects in the
+// background, waiting between attempts according to the lightpad's Reconnect
+// policy. Use SetAddress if the lightpad's address changes and it will be used
+// for the next attempt.
+//
+// If the first connection fails, its error is returned. If the Reconnect
+// policy has a MaxAttempts and that many attempts in a row fail, a final
+// LPEDisconnected carrying a *RetryError is sent and the channel is closed.
+// Otherwise the channel is closed, along with the connection, once the
+// context is done.
+func (l *DefaultLightpad) Subscribe(ctx context.Context) (<-chan Event, error) {
+	conn, err := l.dialStream(ctx)
 	if err != nil {
 		logrus.WithField("error", err).Debug("failed to connect to lightpad")
-		return err
+		return nil, err
 	}
-	go func() {
-		for {
-			// fmt.Println("beg loop")
-			select {
-			case <-ctx.Done():
-				logrus.WithField("lpid", l.ID).Debug("we've been cancelled")
-				return // we've been cancelled
-			default:
-			}
-			// fmt.Println("in loop")
-			message, err := bufio.NewReader(conn).ReadString('\n')
-			// fmt.Println("got mess")
-			if err != nil {
-				fmt.Printf("got error from subscribed conn %s\n", err)
-				continue
-			}
-			// fmt.Println(message)
-			message = strings.TrimSuffix(strings.TrimSpace(message), ".")
-			lpe := lightpadEvent{}
-			err = json.Unmarshal([]byte(message), &lpe)
-			if err != nil {
-				l.StateChanges <- lightpadEvent{Error: err}
-			}
-			switch lpe.Type {
-			case "dimmerchange":
-				ev := LPEDimmerChange{}
-				err = json.Unmarshal([]byte(message), &ev)
-				if err != nil {
-					l.StateChanges <- lightpadEvent{Error: err}
-				}
-				l.StateChanges <- ev
-			case "power":
-				ev := LPEPower{}
-				err = json.Unmarshal([]byte(message), &ev)
-				if err != nil {
-					l.StateChanges <- lightpadEvent{Error: err}
-				}
-				l.StateChanges <- ev
-			case "pirSignal":
-				ev := LPEPIRSignal{}
-				err = json.Unmarshal([]byte(message), &ev)
-				if err != nil {
-					l.StateChanges <- lightpadEvent{Error: err}
-				}
-				l.StateChanges <- ev
-			default:
-				l.StateChanges <- LPEUnknown{
-					lightpadEvent{
-						Type: "unknown",
-					},
-					message,
-				}
-
-			}
-		}
-	}()
-	return nil
+	events := make(chan Event, 5)
+	go l.stream(ctx, conn, events)
+	return events, nil
 }
@@ -1,6 +1,8 @@
 package libplumraw
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -8,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -22,11 +25,88 @@ func TestSetLogicalLoadLevel(t *testing.T) {
 	})
 	pad := newMockLightpad(hf)
 	pad.LLID = "load-uuid"
-	err := pad.SetLogicalLoadLevel(123)
+	err := pad.SetLogicalLoadLevel(context.Background(), 123)
 	assert.NoError(t, err)
 
 }
 
+func TestLightpadErrors(t *testing.T) {
+	// the pad rejects our house access token
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+	})
+	pad := newMockLightpad(hf)
+	pad.LLID = "load-uuid"
+	err := pad.SetLogicalLoadLevel(context.Background(), 123)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+	se := &StatusError{}
+	if assert.True(t, errors.As(err, &se)) {
+		assert.Equal(t, "/v2/setLogicalLoadLevel", se.Path)
+		assert.Equal(t, "load-uuid", se.ID)
+	}
+
+	// metrics that can't be decoded
+	hf = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"level":`))
+	})
+	pad = newMockLightpad(hf)
+	_, err = pad.GetLogicalLoadMetrics(context.Background())
+	assert.True(t, errors.Is(err, ErrMalformedResponse))
+}
+
+func TestLightpadTimeout(t *testing.T) {
+	// the pad never answers until the test is over
+	done := make(chan struct{})
+	defer close(done)
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	})
+	pad := newMockLightpad(hf)
+	pad.LLID = "load-uuid"
+
+	// the pad's own timeout applies when the context has no deadline
+	pad.Timeout = 10 * time.Millisecond
+	err := pad.SetLogicalLoadLevel(context.Background(), 123)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, errors.Is(err, ErrTimeout))
+
+	// a sooner deadline on the call wins over the pad's timeout
+	pad.Timeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = pad.GetLogicalLoadMetrics(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < time.Minute)
+
+	// cancelling the call abandons it
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = pad.SetLogicalLoadGlow(ctx, ForceGlow{LLID: "load-uuid"})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.False(t, errors.Is(err, ErrTimeout))
+}
+
+func TestLightpadConcurrentCalls(t *testing.T) {
+	pad := newMockLightpad(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func(level int) {
+			errs <- pad.SetLogicalLoadLevel(context.Background(), level)
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, <-errs)
+	}
+	// the shared client is used without being stored on the lightpad
+	assert.Nil(t, pad.HttpClient)
+}
+
 func newMockLightpad(handler http.Handler) *DefaultLightpad {
 	ts := httptest.NewTLSServer(handler)
 	ipPort := strings.Split(strings.TrimPrefix(ts.URL, "https://"), ":")
@@ -38,3 +118,54 @@ func newMockLightpad(handler http.Handler) *DefaultLightpad {
 	}
 	return pad
 }
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return nil
+}
+
+func TestSetAddress(t *testing.T) {
+	pad := &DefaultLightpad{IP: net.ParseIP("127.0.0.2"), StreamPort: 2709}
+	pad.SetAddress(net.ParseIP("127.0.0.1"), 8443)
+	ip, port := pad.address()
+	assert.Equal(t, "127.0.0.1", ip.String())
+	assert.Equal(t, 8443, port)
+	assert.Equal(t, "127.0.0.1:2709", pad.streamAddr())
+	// lightpads can still be copied; go vet complains if a lock creeps in
+	cp := *pad
+	assert.Equal(t, 8443, cp.Port)
+
+	// the stream is on the default port unless told otherwise
+	pad.StreamPort = 0
+	assert.Equal(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(DefaultLightpadStreamPort)), pad.streamAddr())
+}
+
+func TestTestLightpadSubscribe(t *testing.T) {
+	pad := &TestLightpad{Events: []Event{
+		LPEDimmerChange{LightpadEvent{Type: "dimmerchange"}, 10},
+		LPEPower{LightpadEvent{Type: "power"}, 60},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := pad.Subscribe(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, pad.Events[0], nextEvent(t, events))
+	assert.Equal(t, pad.Events[1], nextEvent(t, events))
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %v", ev)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel()
+	_, open := <-events
+	assert.False(t, open)
+
+	padErr := errors.New("unreachable")
+	pad.Error = &padErr
+	_, err = pad.Subscribe(context.Background())
+	assert.Equal(t, padErr, err)
+}
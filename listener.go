@@ -2,6 +2,7 @@ package libplumraw
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -17,69 +18,149 @@ type LightpadAnnouncement struct {
 	Port int
 }
 
-type DefaultLightpadHeartbeat struct{}
+// DefaultLightpadHeartbeat listens for the UDP heartbeats lightpads broadcast.
+// The zero value listens on every address on DefaultLightpadHeartbeatPort.
+type DefaultLightpadHeartbeat struct {
+	// Addr is the local address to listen on. Empty means all of them.
+	Addr string
+	// Port to listen on. Zero means DefaultLightpadHeartbeatPort.
+	Port int
+	// FromInterface, if set, is the name of a network interface (eg "eth0").
+	// Only heartbeats sent from an address on one of its subnets are
+	// reported. It filters by sender only: the listener still binds Addr,
+	// and so every interface if Addr is empty.
+	FromInterface string
+	// OnError, if set, is called with each error met while listening, such as
+	// a failed read or a malformed heartbeat. Listening carries on afterwards.
+	OnError func(error)
+}
 
-func (d *DefaultLightpadHeartbeat) Listen(ctx context.Context) chan LightpadAnnouncement {
-	logrus.Debug("about to listen for broadcast heartbeats")
-	/* Lets prepare a address at any address at port */
-	ServerAddr, err := net.ResolveUDPAddr("udp", ":43770")
+// Listen starts listening for heartbeats and sends an announcement for each
+// one received. It returns an error if it can't listen, for example because
+// the port is in use. The socket is held until the context is done, when it
+// is closed along with the channel, so pass a context that will be cancelled.
+func (d *DefaultLightpadHeartbeat) Listen(ctx context.Context) (<-chan LightpadAnnouncement, error) {
+	port := d.Port
+	if port == 0 {
+		port = DefaultLightpadHeartbeatPort
+	}
+	var subnets []*net.IPNet
+	if d.FromInterface != "" {
+		var err error
+		subnets, err = interfaceSubnets(d.FromInterface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(d.Addr, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	/* Now listen at selected port */
-	ServerConn, err := net.ListenUDP("udp", ServerAddr)
+	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	logrus.WithField("addr", conn.LocalAddr()).Debug("listening for broadcast heartbeats")
 
-	buf := make([]byte, 1024)
-
-	responses := make(chan LightpadAnnouncement, 0)
-
+	responses := make(chan LightpadAnnouncement)
+	done := make(chan struct{})
+	// closing the connection wakes up the read below
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
 	go func() {
-		defer ServerConn.Close()
+		defer close(responses)
+		defer close(done)
+		defer conn.Close()
+		buf := make([]byte, 1024)
 		for {
-			select {
-			case <-ctx.Done():
-				fmt.Println("got cancel; bailing.")
-				return
-			default:
-			}
-			ServerConn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			n, addr, err := ServerConn.ReadFromUDP(buf)
+			n, from, err := conn.ReadFromUDP(buf)
 			if err != nil {
-				if err.(*net.OpError).Timeout() {
-					continue
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
 				}
-				panic(err)
-			}
-			msg := string(buf[0:n])
-			// 2017-07-29 15:34:41.655324026 -0700 PDT Received  PLUM 8888 8429176c-bf88-4aee-be07-b6a9064cf1ab 8443  from  192.168.1.91:54209
-			fmt.Println(time.Now(), "Received ", msg, " from ", addr)
-
-			if strings.HasPrefix(msg, "PLUM 8888") {
-				bits := strings.Split(msg, " ")
-				if len(bits) == 4 {
-					port, err := strconv.Atoi(bits[3])
-					if err != nil {
-						fmt.Printf("couldn't parse port from lightpad announcement: %s", bits[3])
-						continue
-					}
-					la := LightpadAnnouncement{
-						ID:   bits[2],
-						IP:   addr.IP,
-						Port: port,
-					}
-					responses <- la
-					// make a new buf to erase the contents of the old one from memory
-					buf = make([]byte, 1024)
+				d.report(err)
+				// don't spin if reads keep failing
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(100 * time.Millisecond):
 				}
+				continue
+			}
+			if subnets != nil && !inSubnets(subnets, from.IP) {
+				continue
 			}
+			la, err := parseHeartbeat(string(buf[:n]), from.IP)
 			if err != nil {
-				fmt.Println("Error: ", err)
+				d.report(err)
+				continue
+			}
+			select {
+			case responses <- la:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
-	return responses
+	return responses, nil
+}
+
+func (d *DefaultLightpadHeartbeat) report(err error) {
+	logrus.WithError(err).Debug("error listening for heartbeats")
+	if d.OnError != nil {
+		d.OnError(err)
+	}
+}
+
+// parseHeartbeat parses a heartbeat sent from ip, which looks like
+// "PLUM 8888 8429176c-bf88-4aee-be07-b6a9064cf1ab 8443"
+func parseHeartbeat(msg string, ip net.IP) (LightpadAnnouncement, error) {
+	bits := strings.Fields(msg)
+	if len(bits) != 4 || bits[0] != "PLUM" || bits[1] != "8888" {
+		return LightpadAnnouncement{}, fmt.Errorf("malformed heartbeat %q from %s", msg, ip)
+	}
+	port, err := strconv.Atoi(bits[3])
+	if err != nil || port < 1 || port > 65535 {
+		return LightpadAnnouncement{}, fmt.Errorf("bad port in heartbeat %q from %s", msg, ip)
+	}
+	return LightpadAnnouncement{
+		ID:   bits[2],
+		IP:   ip,
+		Port: port,
+	}, nil
+}
+
+func interfaceSubnets(name string) ([]*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var subnets []*net.IPNet
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			subnets = append(subnets, ipnet)
+		}
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses", name)
+	}
+	return subnets, nil
+}
+
+func inSubnets(subnets []*net.IPNet, ip net.IP) bool {
+	for _, s := range subnets {
+		if s.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,144 @@
+package libplumraw
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// freeUDPPort finds a port nothing is listening on
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func sendHeartbeat(t *testing.T, port int, msg string) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(msg))
+}
+
+func nextAnnouncement(t *testing.T, ch <-chan LightpadAnnouncement) LightpadAnnouncement {
+	select {
+	case la := <-ch:
+		return la
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for announcement")
+	}
+	return LightpadAnnouncement{}
+}
+
+func TestHeartbeatListen(t *testing.T) {
+	port := freeUDPPort(t)
+	errs := make(chan error, 5)
+	hb := &DefaultLightpadHeartbeat{
+		Addr:          "127.0.0.1",
+		Port:          port,
+		FromInterface: loopbackInterface(t),
+		OnError:       func(err error) { errs <- err },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := hb.Listen(ctx)
+	assert.NoError(t, err)
+
+	sendHeartbeat(t, port, "PLUM 8888 pad1 8443")
+	la := nextAnnouncement(t, ch)
+	assert.Equal(t, "pad1", la.ID)
+	assert.Equal(t, 8443, la.Port)
+	assert.Equal(t, "127.0.0.1", la.IP.String())
+
+	// a bad heartbeat is reported and listening carries on
+	sendHeartbeat(t, port, "PLUM 8888 pad1")
+	select {
+	case err := <-errs:
+		assert.Contains(t, err.Error(), "malformed heartbeat")
+	case <-time.After(2 * time.Second):
+		t.Fatal("no error reported")
+	}
+	sendHeartbeat(t, port, "PLUM 8888 pad2 8443\n")
+	assert.Equal(t, "pad2", nextAnnouncement(t, ch).ID)
+
+	// a second listener on the same port fails instead of panicking
+	_, err = (&DefaultLightpadHeartbeat{Addr: "127.0.0.1", Port: port}).Listen(ctx)
+	assert.Error(t, err)
+
+	cancel()
+	for range ch {
+	}
+	// the socket is closed once listening stops
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	_, err = (&DefaultLightpadHeartbeat{Addr: "127.0.0.1", Port: port}).Listen(ctx)
+	assert.NoError(t, err)
+}
+
+func TestHeartbeatListenErrors(t *testing.T) {
+	_, err := (&DefaultLightpadHeartbeat{FromInterface: "no-such-interface0"}).Listen(context.Background())
+	assert.Error(t, err)
+	_, err = (&DefaultLightpadHeartbeat{Addr: "not an address", Port: 1}).Listen(context.Background())
+	assert.Error(t, err)
+}
+
+func TestHeartbeatInterfaceFilter(t *testing.T) {
+	subnets := []*net.IPNet{{IP: net.ParseIP("192.168.1.0"), Mask: net.CIDRMask(24, 32)}}
+	assert.True(t, inSubnets(subnets, net.ParseIP("192.168.1.91")))
+	assert.False(t, inSubnets(subnets, net.ParseIP("192.168.2.91")))
+}
+
+func TestParseHeartbeat(t *testing.T) {
+	ip := net.ParseIP("192.168.1.91")
+	la, err := parseHeartbeat("PLUM 8888 8429176c-bf88-4aee-be07-b6a9064cf1ab 8443", ip)
+	assert.NoError(t, err)
+	assert.Equal(t, LightpadAnnouncement{ID: "8429176c-bf88-4aee-be07-b6a9064cf1ab", IP: ip, Port: 8443}, la)
+	for _, msg := range []string{"", "PLUM", "PLUM 8888 id", "PLUM 8888 id port", "PLUM 8888 id 99999", "HELLO 8888 id 8443", "PLUM 8888 id 8443 extra"} {
+		_, err := parseHeartbeat(msg, ip)
+		assert.Error(t, err, msg)
+	}
+}
+
+func TestTestLightpadHeartbeat(t *testing.T) {
+	hb := &TestLightpadHeartbeat{
+		LightpadAnnouncement: LightpadAnnouncement{ID: "pad1", Port: 8443},
+		Interval:             time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := hb.Listen(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "pad1", nextAnnouncement(t, ch).ID)
+	assert.Equal(t, "pad1", nextAnnouncement(t, ch).ID)
+	cancel()
+	for range ch {
+	}
+
+	hbErr := errors.New("no network")
+	hb.Error = &hbErr
+	_, err = hb.Listen(context.Background())
+	assert.Equal(t, hbErr, err)
+}
+
+// loopbackInterface is the name of the interface with 127.0.0.1
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
@@ -0,0 +1,410 @@
+/*
+Package plumtest has fakes of the Plum web service and of Lightpads for testing
+code that uses libplumraw against real network connections.
+
+A Cloud is an HTTP server that answers the same calls as the Plum web service
+from an account held in memory. Hand its Config() to
+libplumraw.NewWebConnection() and everything the connection does goes to the
+fake instead of the Internet.
+
+A StreamServer is a fake of a lightpad's event stream. Tests push events, drop
+the connection or send garbage through it to exercise Lightpad.Subscribe.
+
+A VirtualLightpad goes further and emulates a whole switch: its HTTPS API, its
+event stream and its UDP heartbeat. VirtualLightpads on the same VirtualLoad
+stay in step like the switches of a 3-way circuit.
+*/
+package plumtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+)
+
+// Fault is an error the Cloud returns instead of answering a call
+type Fault struct {
+	// Status is the HTTP status to reply with
+	Status int
+	// Body is the response body to send, if any
+	Body string
+	// Times is how many calls get the fault before it clears. Zero means it
+	// never clears.
+	Times int
+}
+
+// Cloud is a fake Plum web service. It serves the houses, rooms, logical loads,
+// lightpads and scenes added to it, requires basic auth with its Email and
+// Password, and replies 404 for IDs it doesn't know.
+type Cloud struct {
+	Email    string
+	Password string
+
+	server *httptest.Server
+
+	mu      sync.Mutex
+	hids    libplumraw.Houses
+	houses  map[string]libplumraw.House
+	rooms   map[string]libplumraw.Room
+	loads   map[string]libplumraw.LogicalLoad
+	pads    map[string]libplumraw.LightpadSpec
+	scenes  map[string]libplumraw.Scene
+	sids    libplumraw.Scenes
+	nextSID int
+	faults  map[string]*Fault
+	latency time.Duration
+	calls   map[string]int
+}
+
+// NewCloud starts a fake Plum web service that accepts the given credentials.
+// Call Close when done with it.
+func NewCloud(email, password string) *Cloud {
+	c := &Cloud{
+		Email:    email,
+		Password: password,
+		houses:   make(map[string]libplumraw.House),
+		rooms:    make(map[string]libplumraw.Room),
+		loads:    make(map[string]libplumraw.LogicalLoad),
+		pads:     make(map[string]libplumraw.LightpadSpec),
+		scenes:   make(map[string]libplumraw.Scene),
+		faults:   make(map[string]*Fault),
+		calls:    make(map[string]int),
+	}
+	c.server = httptest.NewServer(http.HandlerFunc(c.serveHTTP))
+	return c
+}
+
+// URL is the base URL of the fake service
+func (c *Cloud) URL() string {
+	return c.server.URL
+}
+
+// Config returns a WebConnectionConfig that connects to the fake service
+func (c *Cloud) Config() libplumraw.WebConnectionConfig {
+	return libplumraw.WebConnectionConfig{
+		Email:      c.Email,
+		Password:   c.Password,
+		PlumAPIURL: c.server.URL,
+	}
+}
+
+// Close shuts down the fake service
+func (c *Cloud) Close() {
+	c.server.Close()
+}
+
+// AddHouse adds (or replaces) a house in the account
+func (c *Cloud) AddHouse(house libplumraw.House) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.houses[house.ID]; !ok {
+		c.hids = append(c.hids, house.ID)
+	}
+	c.houses[house.ID] = house
+}
+
+// AddRoom adds (or replaces) a room and lists it in its house, if the house
+// has been added
+func (c *Cloud) AddRoom(room libplumraw.Room) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rooms[room.ID] = room
+	if h, ok := c.houses[room.HouseID]; ok {
+		h.RoomIDs = appendMissing(h.RoomIDs, room.ID)
+		c.houses[h.ID] = h
+	}
+}
+
+// AddLogicalLoad adds (or replaces) a logical load and lists it in its room,
+// if the room has been added
+func (c *Cloud) AddLogicalLoad(ll libplumraw.LogicalLoad) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loads[ll.ID] = ll
+	if r, ok := c.rooms[ll.RoomID]; ok {
+		r.LLIDs = appendMissing(r.LLIDs, ll.ID)
+		c.rooms[r.ID] = r
+	}
+}
+
+// AddLightpad adds (or replaces) a lightpad and lists it in its logical load,
+// if the load has been added
+func (c *Cloud) AddLightpad(lp libplumraw.LightpadSpec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pads[lp.ID] = lp
+	if ll, ok := c.loads[lp.LLID]; ok {
+		ll.LPIDs = appendMissing(ll.LPIDs, lp.ID)
+		c.loads[ll.ID] = ll
+	}
+}
+
+// AddScene adds (or replaces) a scene
+func (c *Cloud) AddScene(scene libplumraw.Scene) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.scenes[scene.ID]; !ok {
+		c.sids = append(c.sids, scene.ID)
+	}
+	c.scenes[scene.ID] = scene
+}
+
+// House returns the house as it currently is in the account, including any
+// changes made through the fake service
+func (c *Cloud) House(hid string) (libplumraw.House, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.houses[hid]
+	return h, ok
+}
+
+// Room returns the room as it currently is in the account
+func (c *Cloud) Room(rid string) (libplumraw.Room, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.rooms[rid]
+	return r, ok
+}
+
+// Scene returns the scene as it currently is in the account
+func (c *Cloud) Scene(sid string) (libplumraw.Scene, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.scenes[sid]
+	return s, ok
+}
+
+// InjectFault makes calls to the API path (eg "/v2/getRoom") fail. Passing
+// an empty path makes every call fail.
+func (c *Cloud) InjectFault(path string, f Fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults[path] = &f
+}
+
+// ClearFaults removes all injected faults
+func (c *Cloud) ClearFaults() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = make(map[string]*Fault)
+}
+
+// SetLatency delays every reply by d
+func (c *Cloud) SetLatency(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latency = d
+}
+
+// Calls returns how many calls have been made to the API path, including
+// those that failed
+func (c *Cloud) Calls(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[path]
+}
+
+func appendMissing(ids libplumraw.IDs, id string) libplumraw.IDs {
+	for _, have := range ids {
+		if have == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+// request is the union of the fields sent in calls to the web service
+type request struct {
+	HID      string                     `json:"hid"`
+	SID      string                     `json:"sid"`
+	RID      string                     `json:"rid"`
+	LLID     string                     `json:"llid"`
+	LPID     string                     `json:"lpid"`
+	Settings []libplumraw.SceneSettings `json:"settings"`
+	// names for scenes, rooms, loads and lightpads
+	SceneName    string `json:"scene_name"`
+	RoomName     string `json:"room_name"`
+	LoadName     string `json:"logical_load_name"`
+	LightpadName string `json:"lightpad_name"`
+}
+
+func (c *Cloud) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.calls[r.URL.Path]++
+	latency := c.latency
+	faultPath := r.URL.Path
+	fault, faulted := c.faults[faultPath]
+	if !faulted {
+		faultPath = ""
+		fault, faulted = c.faults[faultPath]
+	}
+	var f Fault
+	if faulted {
+		f = *fault
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				delete(c.faults, faultPath)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if faulted {
+		w.WriteHeader(f.Status)
+		w.Write([]byte(f.Body))
+		return
+	}
+	email, password, ok := r.BasicAuth()
+	if !ok || email != c.Email || password != c.Password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == "/v2/getHouses" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		c.mu.Lock()
+		hids := append(libplumraw.Houses{}, c.hids...)
+		c.mu.Unlock()
+		reply(w, hids)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch r.URL.Path {
+	case "/v2/getHouse":
+		h, ok := c.houses[req.HID]
+		replyIf(w, h, ok)
+	case "/v2/getScenes":
+		if _, ok := c.houses[req.HID]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sids := libplumraw.Scenes{}
+		for _, sid := range c.sids {
+			if c.scenes[sid].HouseID == req.HID {
+				sids = append(sids, sid)
+			}
+		}
+		reply(w, sids)
+	case "/v2/getScene":
+		s, ok := c.scenes[req.SID]
+		replyIf(w, s, ok)
+	case "/v2/getRoom":
+		room, ok := c.rooms[req.RID]
+		replyIf(w, room, ok)
+	case "/v2/getLogicalLoad":
+		ll, ok := c.loads[req.LLID]
+		replyIf(w, ll, ok)
+	case "/v2/getLightpad":
+		lp, ok := c.pads[req.LPID]
+		replyIf(w, lp, ok)
+	case "/v2/createScene":
+		if _, ok := c.houses[req.HID]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		c.nextSID++
+		s := libplumraw.Scene{
+			ID:       "scene-" + strconv.Itoa(c.nextSID),
+			HouseID:  req.HID,
+			Name:     req.SceneName,
+			Settings: req.Settings,
+		}
+		c.scenes[s.ID] = s
+		c.sids = append(c.sids, s.ID)
+		reply(w, struct {
+			SID string `json:"sid"`
+		}{s.ID})
+	case "/v2/updateScene":
+		s, ok := c.scenes[req.SID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.Name = req.SceneName
+		s.Settings = req.Settings
+		c.scenes[s.ID] = s
+		w.WriteHeader(http.StatusNoContent)
+	case "/v2/deleteScene":
+		if _, ok := c.scenes[req.SID]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(c.scenes, req.SID)
+		for i, sid := range c.sids {
+			if sid == req.SID {
+				c.sids = append(c.sids[:i], c.sids[i+1:]...)
+				break
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "/v2/renameRoom":
+		room, ok := c.rooms[req.RID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		room.Name = req.RoomName
+		c.rooms[room.ID] = room
+		w.WriteHeader(http.StatusNoContent)
+	case "/v2/renameLogicalLoad":
+		ll, ok := c.loads[req.LLID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ll.Name = req.LoadName
+		c.loads[ll.ID] = ll
+		w.WriteHeader(http.StatusNoContent)
+	case "/v2/renameLightpad":
+		lp, ok := c.pads[req.LPID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lp.Name = req.LightpadName
+		c.pads[lp.ID] = lp
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func replyIf(w http.ResponseWriter, v interface{}, ok bool) {
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	reply(w, v)
+}
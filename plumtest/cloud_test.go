@@ -0,0 +1,113 @@
+package plumtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCloud() *Cloud {
+	c := NewCloud("me@example.com", "hunter2")
+	c.AddHouse(libplumraw.House{ID: "house1", Name: "home", AccessToken: "hat"})
+	c.AddRoom(libplumraw.Room{ID: "room1", HouseID: "house1", Name: "kitchen"})
+	c.AddLogicalLoad(libplumraw.LogicalLoad{ID: "load1", RoomID: "room1", Name: "pendants"})
+	c.AddLightpad(libplumraw.LightpadSpec{ID: "pad1", LLID: "load1", Name: "by the sink"})
+	c.AddLightpad(libplumraw.LightpadSpec{ID: "pad2", LLID: "load1", Name: "by the door"})
+	c.AddScene(libplumraw.Scene{
+		ID:       "scene1",
+		HouseID:  "house1",
+		Name:     "dinner",
+		Settings: []libplumraw.SceneSettings{{LLID: "load1", Level: 80, Fade: 1000}},
+	})
+	return c
+}
+
+func TestCloudTopology(t *testing.T) {
+	c := newTestCloud()
+	defer c.Close()
+	wc := libplumraw.NewWebConnection(c.Config())
+	ctx := context.Background()
+
+	hids, err := wc.GetHouses(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, libplumraw.Houses{"house1"}, hids)
+
+	topo, err := libplumraw.FetchHouseTopology(ctx, wc, "house1", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "hat", topo.House.AccessToken)
+	if assert.Len(t, topo.Rooms, 1) && assert.Len(t, topo.Rooms[0].LogicalLoads, 1) {
+		lt := topo.Rooms[0].LogicalLoads[0]
+		assert.Equal(t, "pendants", lt.LogicalLoad.Name)
+		assert.Len(t, lt.Lightpads, 2)
+	}
+	if assert.Len(t, topo.Scenes, 1) {
+		assert.Equal(t, 80, topo.Scenes[0].Settings[0].Level)
+	}
+}
+
+func TestCloudErrors(t *testing.T) {
+	c := newTestCloud()
+	defer c.Close()
+	ctx := context.Background()
+
+	// wrong password
+	conf := c.Config()
+	conf.Password = "hunter3"
+	_, err := libplumraw.NewWebConnection(conf).GetHouse(ctx, "house1")
+	assert.True(t, errors.Is(err, libplumraw.ErrUnauthorized))
+
+	wc := libplumraw.NewWebConnection(c.Config())
+	_, err = wc.GetRoom(ctx, "room-gone")
+	assert.True(t, errors.Is(err, libplumraw.ErrNotFound))
+
+	// a fault that clears after two calls is outlasted by retrying
+	c.InjectFault("/v2/getLightpad", Fault{Status: 503, Times: 2})
+	_, err = wc.GetLightpad(ctx, "pad1")
+	assert.True(t, errors.Is(err, libplumraw.ErrServer))
+	conf = c.Config()
+	conf.Retry = &libplumraw.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	lp, err := libplumraw.NewWebConnection(conf).GetLightpad(ctx, "pad1")
+	assert.NoError(t, err)
+	assert.Equal(t, "by the sink", lp.Name)
+	assert.Equal(t, 3, c.Calls("/v2/getLightpad"))
+
+	// latency past the deadline
+	c.SetLatency(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = wc.GetHouse(ctx, "house1")
+	assert.True(t, errors.Is(err, libplumraw.ErrTimeout))
+}
+
+func TestCloudWrites(t *testing.T) {
+	c := newTestCloud()
+	defer c.Close()
+	wc := libplumraw.NewWebConnection(c.Config())
+	ctx := context.Background()
+
+	scene, err := wc.CreateScene(ctx, libplumraw.Scene{HouseID: "house1", Name: "movie"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, scene.ID)
+	sids, err := wc.GetScenes(ctx, "house1")
+	assert.NoError(t, err)
+	assert.Equal(t, libplumraw.Scenes{"scene1", scene.ID}, sids)
+
+	scene.Name = "late movie"
+	assert.NoError(t, wc.UpdateScene(ctx, scene))
+	got, _ := c.Scene(scene.ID)
+	assert.Equal(t, "late movie", got.Name)
+
+	assert.NoError(t, wc.DeleteScene(ctx, scene.ID))
+	_, err = wc.GetScene(ctx, scene.ID)
+	assert.True(t, errors.Is(err, libplumraw.ErrNotFound))
+
+	assert.NoError(t, wc.RenameRoom(ctx, "room1", "galley"))
+	room, _ := c.Room("room1")
+	assert.Equal(t, "galley", room.Name)
+	err = wc.RenameLightpad(ctx, "pad-gone", "nowhere")
+	assert.True(t, errors.Is(err, libplumraw.ErrNotFound))
+}
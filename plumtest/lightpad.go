@@ -0,0 +1,298 @@
+package plumtest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+)
+
+// DefaultVirtualLoadWatts is how much power a VirtualLoad draws at full level
+// when it doesn't say
+const DefaultVirtualLoadWatts = 60
+
+// VirtualLoad is a logical load shared by one or more VirtualLightpads. Like
+// the switches in a 3-way circuit, every lightpad on the load reports the same
+// level, and changing it through any of them is seen on all their event
+// streams.
+type VirtualLoad struct {
+	LLID string
+	// Watts is the power drawn at full level. Zero means
+	// DefaultVirtualLoadWatts.
+	Watts int
+
+	mu    sync.Mutex
+	level int
+	pads  []*VirtualLightpad
+}
+
+// NewVirtualLoad returns a load that's off
+func NewVirtualLoad(llid string) *VirtualLoad {
+	return &VirtualLoad{LLID: llid}
+}
+
+// Level is the load's current level, 0-255
+func (v *VirtualLoad) Level() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.level
+}
+
+// SetLevel changes the level as if someone had used one of the switches, and
+// sends dimmerchange and power events from every lightpad on the load
+func (v *VirtualLoad) SetLevel(level int) {
+	if level < 0 {
+		level = 0
+	}
+	if level > 255 {
+		level = 255
+	}
+	v.mu.Lock()
+	v.level = level
+	pads := append([]*VirtualLightpad(nil), v.pads...)
+	watts := v.power(level)
+	v.mu.Unlock()
+	for _, p := range pads {
+		// a lightpad with no one listening has no one to tell
+		p.stream.Push(libplumraw.LPEDimmerChange{Level: level})
+		p.stream.Push(libplumraw.LPEPower{Watts: watts})
+	}
+}
+
+// power is what the load draws at level
+func (v *VirtualLoad) power(level int) int {
+	watts := v.Watts
+	if watts == 0 {
+		watts = DefaultVirtualLoadWatts
+	}
+	return watts * level / 255
+}
+
+func (v *VirtualLoad) metrics() libplumraw.LogicalLoadMetrics {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m := libplumraw.LogicalLoadMetrics{
+		Level: v.level,
+		Power: v.power(v.level),
+	}
+	// the load's power is shared by its switches; the first one carries it
+	for i, p := range v.pads {
+		pm := libplumraw.LightpadMetric{ID: p.ID, Level: v.level}
+		if i == 0 {
+			pm.Power = m.Power
+		}
+		m.Metrics = append(m.Metrics, pm)
+	}
+	return m
+}
+
+// VirtualLightpad emulates a lightpad: it serves the lightpad's HTTPS API, with
+// the house access token checked on every call, sends events on a
+// StreamServer, and can send UDP heartbeats announcing itself.
+type VirtualLightpad struct {
+	ID  string
+	HAT string
+
+	load   *VirtualLoad
+	https  *httptest.Server
+	stream *StreamServer
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	config libplumraw.LightpadConfig
+	glow   libplumraw.ForceGlow
+	calls  map[string]int
+}
+
+// NewVirtualLightpad starts a lightpad on the load. hat is the house access
+// token callers must present. Call Close when done with it.
+func NewVirtualLightpad(lpid, hat string, load *VirtualLoad) *VirtualLightpad {
+	p := &VirtualLightpad{
+		ID:     lpid,
+		HAT:    hat,
+		load:   load,
+		stream: NewStreamServer(),
+		done:   make(chan struct{}),
+		calls:  make(map[string]int),
+	}
+	p.https = httptest.NewTLSServer(http.HandlerFunc(p.serveHTTP))
+	load.mu.Lock()
+	load.pads = append(load.pads, p)
+	load.mu.Unlock()
+	return p
+}
+
+// Lightpad returns a lightpad set up to talk to the emulator
+func (p *VirtualLightpad) Lightpad() *libplumraw.DefaultLightpad {
+	addr := p.https.Listener.Addr().(*net.TCPAddr)
+	return &libplumraw.DefaultLightpad{
+		ID:         p.ID,
+		LLID:       p.load.LLID,
+		IP:         addr.IP,
+		Port:       addr.Port,
+		StreamPort: p.stream.Addr().Port,
+		HAT:        p.HAT,
+	}
+}
+
+// Port is the port the HTTPS API listens on
+func (p *VirtualLightpad) Port() int {
+	return p.https.Listener.Addr().(*net.TCPAddr).Port
+}
+
+// Stream is the lightpad's event stream, for pushing extra events or faults
+func (p *VirtualLightpad) Stream() *StreamServer {
+	return p.stream
+}
+
+// Load is the logical load the lightpad controls
+func (p *VirtualLightpad) Load() *VirtualLoad {
+	return p.load
+}
+
+// Config is the configuration set through the API
+func (p *VirtualLightpad) Config() libplumraw.LightpadConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config
+}
+
+// Glow is the last glow forced through the API
+func (p *VirtualLightpad) Glow() libplumraw.ForceGlow {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.glow
+}
+
+// Calls returns how many calls have been made to the API path, including
+// those that failed
+func (p *VirtualLightpad) Calls(path string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[path]
+}
+
+// Heartbeat is the message the lightpad broadcasts to announce itself
+func (p *VirtualLightpad) Heartbeat() string {
+	return fmt.Sprintf("PLUM 8888 %s %d", p.ID, p.Port())
+}
+
+// SendHeartbeat sends one heartbeat to addr
+func (p *VirtualLightpad) SendHeartbeat(addr *net.UDPAddr) error {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(p.Heartbeat()))
+	return err
+}
+
+// StartHeartbeats sends a heartbeat to addr straight away and then every
+// interval until the lightpad is closed. Real lightpads broadcast to
+// DefaultLightpadHeartbeatPort about every 5 minutes.
+func (p *VirtualLightpad) StartHeartbeats(addr *net.UDPAddr, interval time.Duration) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			p.SendHeartbeat(addr)
+			select {
+			case <-p.done:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+}
+
+// Close shuts down the lightpad and takes it off its load
+func (p *VirtualLightpad) Close() {
+	close(p.done)
+	p.wg.Wait()
+	p.https.Close()
+	p.stream.Close()
+	v := p.load
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for i, have := range v.pads {
+		if have == p {
+			v.pads = append(v.pads[:i], v.pads[i+1:]...)
+			break
+		}
+	}
+}
+
+// padRequest is the union of the fields sent in calls to a lightpad
+type padRequest struct {
+	LLID   string          `json:"llid"`
+	Level  *int            `json:"level"`
+	Config json.RawMessage `json:"config"`
+	libplumraw.ForceGlow
+}
+
+func (p *VirtualLightpad) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.calls[r.URL.Path]++
+	p.mu.Unlock()
+
+	want := fmt.Sprintf("%x", sha256.Sum256([]byte(p.HAT)))
+	if r.Header.Get("X-Plum-House-Access-Token") != want {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req := padRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.LLID != p.load.LLID {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v2/setLogicalLoadLevel":
+		if req.Level == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		p.load.SetLevel(*req.Level)
+		w.WriteHeader(http.StatusNoContent)
+	case "/v2/setLogicalLoadConfig":
+		changes := libplumraw.LightpadConfig{}
+		if err := json.Unmarshal(req.Config, &changes); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		// unmarshalling again over the old config changes only what was sent
+		json.Unmarshal(req.Config, &p.config)
+		p.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		p.stream.Push(libplumraw.LPEConfigChange{Changes: changes})
+	case "/v2/getLogicalLoadMetrics":
+		reply(w, p.load.metrics())
+	case "/v2/setLogicalLoadGlow":
+		p.mu.Lock()
+		p.glow = req.ForceGlow
+		p.glow.LLID = req.LLID
+		p.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,111 @@
+package plumtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualLightpad(t *testing.T) {
+	load := NewVirtualLoad("load1")
+	pad1 := NewVirtualLightpad("pad1", "hat", load)
+	defer pad1.Close()
+	pad2 := NewVirtualLightpad("pad2", "hat", load)
+	defer pad2.Close()
+	ctx := context.Background()
+
+	// the second switch on the load hears about changes made at the first
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events, err := pad2.Lightpad().Subscribe(sctx)
+	assert.NoError(t, err)
+	assert.Equal(t, libplumraw.Connected, nextEvent(t, events).Kind())
+
+	lp := pad1.Lightpad()
+	err = lp.SetLogicalLoadLevel(ctx, 255)
+	assert.NoError(t, err)
+	dc, ok := nextEvent(t, events).(libplumraw.LPEDimmerChange)
+	assert.True(t, ok)
+	assert.Equal(t, 255, dc.Level)
+	assert.Equal(t, "pad2", dc.LPID())
+	pw, ok := nextEvent(t, events).(libplumraw.LPEPower)
+	assert.True(t, ok)
+	assert.Equal(t, DefaultVirtualLoadWatts, pw.Watts)
+
+	metrics, err := pad2.Lightpad().GetLogicalLoadMetrics(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 255, metrics.Level)
+	assert.Equal(t, 60, metrics.Power)
+	assert.Equal(t, []libplumraw.LightpadMetric{
+		{ID: "pad1", Level: 255, Power: 60},
+		{ID: "pad2", Level: 255},
+	}, metrics.Metrics)
+
+	// someone dims the lights at the switch
+	load.SetLevel(51)
+	assert.Equal(t, 51, nextEvent(t, events).(libplumraw.LPEDimmerChange).Level)
+	assert.Equal(t, 12, nextEvent(t, events).(libplumraw.LPEPower).Watts)
+
+	err = lp.SetLogicalLoadConfig(ctx, libplumraw.LogicalLoadConfig{GlowEnabled: true, GlowTimeout: 30})
+	assert.NoError(t, err)
+	err = lp.SetLightpadConfig(ctx, libplumraw.LightpadConfig{PIRSensitivity: 100})
+	assert.NoError(t, err)
+	conf := pad1.Config()
+	assert.True(t, conf.GlowEnabled)
+	assert.Equal(t, 30, conf.GlowTimeout)
+	assert.Equal(t, 100, conf.PIRSensitivity)
+
+	glow := libplumraw.ForceGlow{LightpadGlowColor: libplumraw.LightpadGlowColor{Red: 255}, Intensity: 0.5, Timeout: 1000, LLID: "load1"}
+	err = lp.SetLogicalLoadGlow(ctx, glow)
+	assert.NoError(t, err)
+	assert.Equal(t, glow, pad1.Glow())
+	assert.Equal(t, 1, pad1.Calls("/v2/setLogicalLoadGlow"))
+}
+
+func TestVirtualLightpadRejects(t *testing.T) {
+	load := NewVirtualLoad("load1")
+	pad := NewVirtualLightpad("pad1", "hat", load)
+	defer pad.Close()
+	ctx := context.Background()
+
+	lp := pad.Lightpad()
+	lp.HAT = "wrong"
+	err := lp.SetLogicalLoadLevel(ctx, 10)
+	assert.True(t, errors.Is(err, libplumraw.ErrUnauthorized))
+
+	lp = pad.Lightpad()
+	lp.LLID = "load2"
+	err = lp.SetLogicalLoadLevel(ctx, 10)
+	var se *libplumraw.StatusError
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, 400, se.StatusCode)
+	assert.Equal(t, 0, load.Level())
+}
+
+func TestVirtualLightpadHeartbeat(t *testing.T) {
+	load := NewVirtualLoad("load1")
+	pad := NewVirtualLightpad("pad1", "hat", load)
+	defer pad.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pad.StartHeartbeats(conn.LocalAddr().(*net.UDPAddr), 10*time.Millisecond)
+	buf := make([]byte, 1024)
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		assert.NoError(t, err)
+		bits := strings.Split(string(buf[:n]), " ")
+		assert.Equal(t, []string{"PLUM", "8888", "pad1"}, bits[:3])
+		assert.Equal(t, pad.Heartbeat(), string(buf[:n]))
+	}
+}
@@ -0,0 +1,74 @@
+package plumtest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ProbeResponder answers discovery probes the way lightpads do, replying to
+// each one with a heartbeat from every VirtualLightpad added to it. It listens
+// on a port of its own on 127.0.0.1; set a libplumraw.Probe's Addr to Addr().
+type ProbeResponder struct {
+	conn *net.UDPConn
+
+	mu     sync.Mutex
+	pads   []*VirtualLightpad
+	probes int
+}
+
+// NewProbeResponder starts answering probes for the lightpads. Call Close when
+// done with it.
+func NewProbeResponder(pads ...*VirtualLightpad) *ProbeResponder {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		panic(fmt.Sprintf("plumtest: failed to listen: %v", err))
+	}
+	r := &ProbeResponder{conn: conn, pads: pads}
+	go r.serve()
+	return r
+}
+
+func (r *ProbeResponder) serve() {
+	buf := make([]byte, 1024)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if string(buf[:n]) != "PLUM" {
+			continue
+		}
+		r.mu.Lock()
+		r.probes++
+		pads := append([]*VirtualLightpad(nil), r.pads...)
+		r.mu.Unlock()
+		for _, p := range pads {
+			r.conn.WriteToUDP([]byte(p.Heartbeat()), from)
+		}
+	}
+}
+
+// Addr is where to send probes
+func (r *ProbeResponder) Addr() *net.UDPAddr {
+	return r.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Add makes the lightpad answer probes too
+func (r *ProbeResponder) Add(p *VirtualLightpad) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pads = append(r.pads, p)
+}
+
+// Probes is how many probes have been answered
+func (r *ProbeResponder) Probes() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.probes
+}
+
+// Close stops answering probes
+func (r *ProbeResponder) Close() {
+	r.conn.Close()
+}
@@ -0,0 +1,54 @@
+package plumtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe(t *testing.T) {
+	load := NewVirtualLoad("load1")
+	pad1 := NewVirtualLightpad("pad1", "hat", load)
+	defer pad1.Close()
+	pad2 := NewVirtualLightpad("pad2", "hat", load)
+	defer pad2.Close()
+	resp := NewProbeResponder(pad2)
+	defer resp.Close()
+	resp.Add(pad1)
+
+	probe := &libplumraw.Probe{
+		Addr:   resp.Addr(),
+		Window: 100 * time.Millisecond,
+		Repeat: 2,
+	}
+	found, err := probe.Discover(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, resp.Probes())
+	if assert.Len(t, found, 2) {
+		assert.Equal(t, "pad1", found[0].ID)
+		assert.Equal(t, pad1.Port(), found[0].Port)
+		assert.Equal(t, "127.0.0.1", found[0].IP.String())
+		assert.Equal(t, "pad2", found[1].ID)
+	}
+
+	// the found lightpads can be used straight away
+	lp := &libplumraw.DefaultLightpad{ID: found[0].ID, LLID: "load1", IP: found[0].IP, Port: found[0].Port, HAT: "hat"}
+	assert.NoError(t, lp.SetLogicalLoadLevel(context.Background(), 9))
+	assert.Equal(t, 9, load.Level())
+}
+
+func TestProbeCancel(t *testing.T) {
+	resp := NewProbeResponder()
+	defer resp.Close()
+	probe := &libplumraw.Probe{Addr: resp.Addr(), Window: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	found, err := probe.Discover(ctx)
+	assert.Empty(t, found)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 10*time.Second)
+}
@@ -0,0 +1,194 @@
+package plumtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+)
+
+// ErrNoClients is returned when pushing to a StreamServer nobody is connected to
+var ErrNoClients = errors.New("no clients connected to the stream")
+
+// StreamServer is a fake of the event stream a lightpad serves, which sends
+// one JSON message per line to everyone connected. It listens on a port of its
+// own on 127.0.0.1; point a DefaultLightpad at it with Lightpad() or by setting
+// IP and StreamPort from Addr().
+type StreamServer struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	accepts int
+	changed chan struct{}
+}
+
+// NewStreamServer starts a fake event stream. Call Close when done with it.
+func NewStreamServer() *StreamServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("plumtest: failed to listen: %v", err))
+	}
+	s := &StreamServer{
+		ln:      ln,
+		conns:   make(map[net.Conn]struct{}),
+		changed: make(chan struct{}),
+	}
+	go s.accept()
+	return s
+}
+
+func (s *StreamServer) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.accepts++
+		s.notify()
+		s.mu.Unlock()
+		// lightpads ignore anything sent to them; reading notices hang ups
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					break
+				}
+			}
+			s.mu.Lock()
+			if _, ok := s.conns[conn]; ok {
+				delete(s.conns, conn)
+				s.notify()
+			}
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// notify wakes up anyone waiting in WaitForClients. s.mu must be held.
+func (s *StreamServer) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Addr is the server's address
+func (s *StreamServer) Addr() *net.TCPAddr {
+	return s.ln.Addr().(*net.TCPAddr)
+}
+
+// Lightpad returns a lightpad whose event stream comes from the server
+func (s *StreamServer) Lightpad(lpid, llid string) *libplumraw.DefaultLightpad {
+	return &libplumraw.DefaultLightpad{
+		ID:         lpid,
+		LLID:       llid,
+		IP:         s.Addr().IP,
+		StreamPort: s.Addr().Port,
+	}
+}
+
+// Clients is how many connections are open now
+func (s *StreamServer) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Accepted is how many connections have been made in all, including those
+// since closed; it goes up by one each time a client reconnects
+func (s *StreamServer) Accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepts
+}
+
+// WaitForClients waits until Accepted reaches n and a client is connected, so
+// after a Drop tests can wait for the reconnect with the old count plus one.
+// It returns an error if that doesn't happen within the timeout.
+func (s *StreamServer) WaitForClients(n int, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		open, accepted, changed := len(s.conns), s.accepts, s.changed
+		s.mu.Unlock()
+		if accepted >= n && open > 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("%d of %d connections made after %s", accepted, n, timeout)
+		}
+	}
+}
+
+// Push sends an event to every client. v is encoded as JSON; the LPE types
+// from libplumraw encode as the lightpad would send them, with their type
+// filled in from Kind if it's empty.
+func (s *StreamServer) Push(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if ev, ok := v.(libplumraw.Event); ok {
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(msg, &fields); err == nil && fields["type"] == "" {
+			fields["type"] = ev.Kind().String()
+			if msg, err = json.Marshal(fields); err != nil {
+				return err
+			}
+		}
+	}
+	return s.write(append(msg, ".\n"...))
+}
+
+// PushLine sends line, followed by a newline, to every client as is
+func (s *StreamServer) PushLine(line string) error {
+	return s.write([]byte(line + "\n"))
+}
+
+// InjectGarbage sends b to every client as is, with no newline added, as if
+// the lightpad had sent something corrupt
+func (s *StreamServer) InjectGarbage(b []byte) error {
+	return s.write(b)
+}
+
+func (s *StreamServer) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.conns) == 0 {
+		return ErrNoClients
+	}
+	var errs []error
+	for conn := range s.conns {
+		if _, err := conn.Write(b); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Drop hangs up on every client, as if the lightpad had rebooted. Clients may
+// connect again straight away.
+func (s *StreamServer) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	s.notify()
+}
+
+// Close hangs up on every client and stops accepting new ones
+func (s *StreamServer) Close() {
+	s.ln.Close()
+	s.Drop()
+}
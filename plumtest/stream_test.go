@@ -0,0 +1,68 @@
+package plumtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+	"github.com/stretchr/testify/assert"
+)
+
+func nextEvent(t *testing.T, events <-chan libplumraw.Event) libplumraw.Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return nil
+}
+
+func TestStreamServer(t *testing.T) {
+	srv := NewStreamServer()
+	defer srv.Close()
+	assert.Equal(t, ErrNoClients, srv.PushLine(`{"type":"power","watts":1}`))
+
+	pad := srv.Lightpad("pad1", "load1")
+	pad.Reconnect = &libplumraw.RetryPolicy{InitialBackoff: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := pad.Subscribe(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, srv.WaitForClients(1, 2*time.Second))
+	assert.Equal(t, libplumraw.Connected, nextEvent(t, events).Kind())
+
+	// scripted events arrive typed and stamped with the pad
+	err = srv.Push(libplumraw.LPEDimmerChange{Level: 42})
+	assert.NoError(t, err)
+	ev := nextEvent(t, events)
+	dc, ok := ev.(libplumraw.LPEDimmerChange)
+	assert.True(t, ok)
+	assert.Equal(t, 42, dc.Level)
+	assert.Equal(t, "pad1", dc.LPID())
+	assert.Equal(t, `{"level":42,"type":"dimmerchange"}`, string(dc.Raw()))
+	assert.NoError(t, srv.Push(map[string]interface{}{"type": "pirSignal", "signal": 2}))
+	assert.Equal(t, libplumraw.PIRSignal, nextEvent(t, events).Kind())
+
+	// garbage comes through as an error event without breaking the stream
+	assert.NoError(t, srv.InjectGarbage([]byte("\x00\xffnot json\n")))
+	assert.Equal(t, libplumraw.StreamError, nextEvent(t, events).Kind())
+	assert.NoError(t, srv.PushLine(`{"type":"power","watts":7}`))
+	assert.Equal(t, libplumraw.Power, nextEvent(t, events).Kind())
+
+	// dropping the connection makes the pad reconnect
+	srv.Drop()
+	assert.Equal(t, libplumraw.Disconnected, nextEvent(t, events).Kind())
+	assert.NoError(t, srv.WaitForClients(2, 2*time.Second))
+	assert.Equal(t, libplumraw.Connected, nextEvent(t, events).Kind())
+	assert.Equal(t, 1, srv.Clients())
+	assert.NoError(t, srv.Push(libplumraw.LPEPower{Watts: 3}))
+	assert.Equal(t, libplumraw.Power, nextEvent(t, events).Kind())
+
+	// hanging up on the server's side is noticed
+	cancel()
+	for range events {
+	}
+	assert.Eventually(t, func() bool { return srv.Clients() == 0 }, 2*time.Second, time.Millisecond)
+}
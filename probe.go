@@ -0,0 +1,154 @@
+package libplumraw
+
+// probe.go asks lightpads to announce themselves rather than waiting minutes
+// for their next heartbeat.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultProbeWindow is how long a Probe waits for replies when it doesn't say
+const DefaultProbeWindow = 3 * time.Second
+
+// probeMessage is what lightpads answer with a heartbeat
+const probeMessage = "PLUM"
+
+// Probe discovers lightpads by broadcasting a probe on the heartbeat port, as
+// the plum-probe tool does. Every lightpad that hears it replies with a
+// heartbeat. The zero value broadcasts on the local network.
+type Probe struct {
+	// Addr is where the probe is sent. Nil means the broadcast address
+	// 255.255.255.255 on DefaultLightpadHeartbeatPort.
+	Addr *net.UDPAddr
+	// LocalAddr is the address to send from and listen for replies on. Nil
+	// means any address and a port picked by the system.
+	LocalAddr *net.UDPAddr
+	// Window is how long to collect replies. Zero means DefaultProbeWindow.
+	Window time.Duration
+	// Repeat is how many times to send the probe, spread across the window, in
+	// case some are lost. Less than 1 means once.
+	Repeat int
+	// OnError, if set, is called with malformed replies and failed reads.
+	// Collecting replies carries on afterwards.
+	OnError func(error)
+}
+
+// Discover sends the probe and returns an announcement for each lightpad that
+// replied within the window, sorted by ID. If the context is done first the
+// lightpads found so far are returned along with the context's error.
+func (p *Probe) Discover(ctx context.Context) ([]LightpadAnnouncement, error) {
+	window := p.Window
+	if window <= 0 {
+		window = DefaultProbeWindow
+	}
+	repeat := p.Repeat
+	if repeat < 1 {
+		repeat = 1
+	}
+	addr := p.Addr
+	if addr == nil {
+		addr = &net.UDPAddr{IP: net.IPv4bcast, Port: DefaultLightpadHeartbeatPort}
+	}
+	conn, err := net.ListenUDP("udp", p.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(window))
+	// closing the connection wakes up the read below
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	send := func() error {
+		_, err := conn.WriteToUDP([]byte(probeMessage), addr)
+		return err
+	}
+	if err := send(); err != nil {
+		return nil, err
+	}
+	if repeat > 1 {
+		every := window / time.Duration(repeat)
+		go func() {
+			tick := time.NewTicker(every)
+			defer tick.Stop()
+			for i := 1; i < repeat; i++ {
+				select {
+				case <-done:
+					return
+				case <-tick.C:
+				}
+				if err := send(); err != nil {
+					p.report(err)
+				}
+			}
+		}()
+	}
+
+	found := make(map[string]LightpadAnnouncement)
+	buf := make([]byte, 1024)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return sortedAnnouncements(found), ctx.Err()
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return sortedAnnouncements(found), nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return sortedAnnouncements(found), err
+			}
+			p.report(err)
+			// don't spin if reads keep failing; once the window is up the
+			// next read times out
+			select {
+			case <-ctx.Done():
+				return sortedAnnouncements(found), ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+		msg := string(buf[:n])
+		if msg == probeMessage {
+			// our own broadcast, or another controller probing
+			continue
+		}
+		la, err := parseHeartbeat(msg, from.IP)
+		if err != nil {
+			p.report(err)
+			continue
+		}
+		logrus.WithField("lpid", la.ID).WithField("ip", la.IP).Debug("lightpad answered probe")
+		found[la.ID] = la
+	}
+}
+
+func (p *Probe) report(err error) {
+	logrus.WithError(err).Debug("error probing for lightpads")
+	if p.OnError != nil {
+		p.OnError(err)
+	}
+}
+
+func sortedAnnouncements(found map[string]LightpadAnnouncement) []LightpadAnnouncement {
+	las := make([]LightpadAnnouncement, 0, len(found))
+	for _, la := range found {
+		las = append(las, la)
+	}
+	sort.Slice(las, func(i, j int) bool { return las[i].ID < las[j].ID })
+	return las
+}
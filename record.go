@@ -0,0 +1,139 @@
+package libplumraw
+
+// record.go saves what lightpads send on their event streams and plays it back
+// later, for reproducing a sequence of events in tests.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// RecordedEvent is one line of a recording: a message from a lightpad's event
+// stream and when it arrived
+type RecordedEvent struct {
+	Time time.Time `json:"time"`
+	LPID string    `json:"lpid"`
+	LLID string    `json:"llid,omitempty"`
+	// Message is the line the lightpad sent. It's kept as a string since it
+	// isn't always valid JSON.
+	Message string `json:"message"`
+}
+
+// Recorder writes events to a recording, one JSON object per line
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewRecorder returns a Recorder that writes to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Record writes the event to the recording. Events made up by the library
+// rather than sent by the lightpad, such as LPEConnected, have nothing to
+// record and are skipped.
+func (r *Recorder) Record(ev Event) error {
+	if len(ev.Raw()) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(RecordedEvent{
+		Time:    ev.Time(),
+		LPID:    ev.LPID(),
+		LLID:    ev.LLID(),
+		Message: string(ev.Raw()),
+	})
+}
+
+// RecordEvents records everything from events until it's closed, stopping
+// early if writing fails
+func (r *Recorder) RecordEvents(events <-chan Event) error {
+	for ev := range events {
+		if err := r.Record(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRecording reads a recording written by a Recorder
+func ReadRecording(rd io.Reader) ([]RecordedEvent, error) {
+	var recs []RecordedEvent
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec := RecordedEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("recording line %d: %w", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// ReplayOptions controls how Replay plays back a recording
+type ReplayOptions struct {
+	// Speed is how many times faster than real time to play back. Zero means
+	// real time.
+	Speed float64
+	// NoWait sends every event straight away, ignoring the gaps between them
+	NoWait bool
+}
+
+// Replay decodes the recorded messages the same way Subscribe does and sends
+// them on the returned channel, keeping the gaps between them (scaled by
+// opts.Speed) unless opts.NoWait is set. Each event has the time and LPID it
+// was recorded with and is numbered per lightpad like a subscription's
+// events. The channel is closed after the last event or once the context is
+// done.
+func Replay(ctx context.Context, recs []RecordedEvent, opts ReplayOptions) <-chan Event {
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		srcs := make(map[string]*eventSource)
+		start := time.Now()
+		for i, rec := range recs {
+			if !opts.NoWait && i > 0 {
+				offset := time.Duration(float64(rec.Time.Sub(recs[0].Time)) / speed)
+				if wait := time.Until(start.Add(offset)); wait > 0 {
+					t := time.NewTimer(wait)
+					select {
+					case <-ctx.Done():
+						t.Stop()
+						return
+					case <-t.C:
+					}
+				}
+			}
+			src, ok := srcs[rec.LPID]
+			if !ok {
+				src = &eventSource{lpid: rec.LPID}
+				srcs[rec.LPID] = src
+			}
+			src.llid = rec.LLID
+			base := src.base("")
+			base.Received = rec.Time
+			if !sendEvent(ctx, events, decodeEvent(base, []byte(rec.Message))) {
+				return
+			}
+		}
+	}()
+	return events
+}
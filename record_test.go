@@ -0,0 +1,78 @@
+package libplumraw
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordReplay(t *testing.T) {
+	start := time.Date(2018, 3, 1, 20, 0, 0, 0, time.UTC)
+	src := &eventSource{lpid: "pad1", llid: "load1"}
+	received := func(line string, after time.Duration) Event {
+		base := src.base("")
+		base.Received = start.Add(after)
+		return decodeEvent(base, []byte(line))
+	}
+	buf := &bytes.Buffer{}
+	rec := NewRecorder(buf)
+	events := make(chan Event, 5)
+	events <- LPEConnected{src.base(Connected.String()), "10.0.0.2:2708"}
+	events <- received(`{"type":"pirSignal","signal":1}.`, 0)
+	events <- received(`{"type":"dimmerchange","level":200}`, 500*time.Millisecond)
+	events <- received(`not json`, time.Second)
+	close(events)
+	err := rec.RecordEvents(events)
+	assert.NoError(t, err)
+	// the connected event isn't recorded
+	assert.Equal(t, 3, strings.Count(buf.String(), "\n"))
+
+	recs, err := ReadRecording(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []RecordedEvent{
+		{start, "pad1", "load1", `{"type":"pirSignal","signal":1}`},
+		{start.Add(500 * time.Millisecond), "pad1", "load1", `{"type":"dimmerchange","level":200}`},
+		{start.Add(time.Second), "pad1", "load1", `not json`},
+	}, recs)
+
+	var replayed []Event
+	for ev := range Replay(context.Background(), recs, ReplayOptions{NoWait: true}) {
+		replayed = append(replayed, ev)
+	}
+	assert.Equal(t, []LightpadEventType{PIRSignal, DimmerChange, StreamError}, kinds(replayed))
+	assert.Equal(t, 200, replayed[1].(LPEDimmerChange).Level)
+	assert.Equal(t, uint64(2), replayed[1].Seq())
+	assert.Equal(t, "load1", replayed[1].LLID())
+	assert.Equal(t, start.Add(500*time.Millisecond), replayed[1].Time())
+
+	// played back 50 times faster the events take about 20ms
+	began := time.Now()
+	n := 0
+	for range Replay(context.Background(), recs, ReplayOptions{Speed: 50}) {
+		n++
+	}
+	assert.Equal(t, 3, n)
+	assert.True(t, time.Since(began) >= 20*time.Millisecond)
+}
+
+func TestReplayCancel(t *testing.T) {
+	recs := []RecordedEvent{
+		{Time: time.Unix(0, 0), LPID: "pad1", Message: `{"type":"power","watts":1}`},
+		{Time: time.Unix(3600, 0), LPID: "pad1", Message: `{"type":"power","watts":2}`},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := Replay(ctx, recs, ReplayOptions{})
+	assert.Equal(t, Power, nextEvent(t, events).Kind())
+	cancel()
+	_, open := <-events
+	assert.False(t, open)
+}
+
+func TestReadRecordingErrors(t *testing.T) {
+	_, err := ReadRecording(strings.NewReader("{\"lpid\":\"pad1\"}\n\nnope\n"))
+	assert.EqualError(t, err, "recording line 3: invalid character 'o' in literal null (expecting 'u')")
+}
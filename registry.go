@@ -0,0 +1,289 @@
+package libplumraw
+
+// registry.go keeps track of which lightpads are on the network and where, from
+// the heartbeats they broadcast.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often lightpads send a heartbeat
+	DefaultHeartbeatInterval = 5 * time.Minute
+	// DefaultMissedHeartbeats is how many heartbeats in a row a lightpad can
+	// miss before a Registry says it has gone
+	DefaultMissedHeartbeats = 3
+	// DefaultRegistryBuffer is how many notifications a Registry subscriber
+	// can fall behind by before more are dropped
+	DefaultRegistryBuffer = 16
+)
+
+// RegistryConfig controls when a Registry decides a lightpad has gone
+type RegistryConfig struct {
+	// Interval is how often lightpads are expected to send heartbeats. Zero
+	// means DefaultHeartbeatInterval.
+	Interval time.Duration
+	// MissedHeartbeats is how many heartbeats in a row may be missed before
+	// a lightpad expires. Zero means DefaultMissedHeartbeats.
+	MissedHeartbeats int
+}
+
+// LightpadPresence is what a Registry knows about where a lightpad is
+type LightpadPresence struct {
+	LPID string
+	// LLID is only known if it was given to the Registry with SetLLID
+	LLID      string
+	IP        net.IP
+	Port      int
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Stale is set once the lightpad has missed too many heartbeats. Its
+	// last known address is kept in case it comes back.
+	Stale bool
+}
+
+// PresenceChange says what happened to a lightpad
+type PresenceChange int
+
+const (
+	// PresenceAdded is a lightpad heard from for the first time, or again
+	// after it expired
+	PresenceAdded PresenceChange = iota
+	// PresenceMoved is a lightpad announcing a new IP or port
+	PresenceMoved
+	// PresenceExpired is a lightpad that has missed too many heartbeats
+	PresenceExpired
+)
+
+func (c PresenceChange) String() string {
+	switch c {
+	case PresenceAdded:
+		return "added"
+	case PresenceMoved:
+		return "moved"
+	case PresenceExpired:
+		return "expired"
+	}
+	return fmt.Sprintf("PresenceChange(%d)", int(c))
+}
+
+// PresenceEvent is a notification from a Registry
+type PresenceEvent struct {
+	Change   PresenceChange
+	Lightpad LightpadPresence
+	// PreviousIP and PreviousPort are where a lightpad that moved was before
+	PreviousIP   net.IP
+	PreviousPort int
+}
+
+// Registry tracks the lightpads heard from on the network. Feed it with Run,
+// or with Observe from some other source of announcements.
+type Registry struct {
+	conf RegistryConfig
+
+	mu    sync.Mutex
+	pads  map[string]*LightpadPresence
+	llids map[string]string
+	subs  map[chan PresenceEvent]struct{}
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry(conf RegistryConfig) *Registry {
+	return &Registry{
+		conf:  conf,
+		pads:  make(map[string]*LightpadPresence),
+		llids: make(map[string]string),
+		subs:  make(map[chan PresenceEvent]struct{}),
+		now:   time.Now,
+	}
+}
+
+// Run listens for heartbeats and records them until the context is done,
+// expiring lightpads that stop sending them. It returns an error if the
+// listener can't be started, otherwise nil once the context is done.
+func (r *Registry) Run(ctx context.Context, hl HeartbeatListener) error {
+	announcements, err := hl.Listen(ctx)
+	if err != nil {
+		return err
+	}
+	tick := time.NewTicker(r.interval() / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case la, ok := <-announcements:
+			if !ok {
+				return nil
+			}
+			r.Observe(la)
+		case <-tick.C:
+			r.Expire()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (r *Registry) interval() time.Duration {
+	if r.conf.Interval > 0 {
+		return r.conf.Interval
+	}
+	return DefaultHeartbeatInterval
+}
+
+// timeout is how long a lightpad can go unheard before it expires
+func (r *Registry) timeout() time.Duration {
+	missed := r.conf.MissedHeartbeats
+	if missed < 1 {
+		missed = DefaultMissedHeartbeats
+	}
+	return r.interval() * time.Duration(missed)
+}
+
+// Observe records a heartbeat from a lightpad
+func (r *Registry) Observe(la LightpadAnnouncement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	p, ok := r.pads[la.ID]
+	if !ok {
+		p = &LightpadPresence{
+			LPID:      la.ID,
+			LLID:      r.llids[la.ID],
+			IP:        la.IP,
+			Port:      la.Port,
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		r.pads[la.ID] = p
+		r.notify(PresenceEvent{Change: PresenceAdded, Lightpad: *p})
+		return
+	}
+	p.LastSeen = now
+	prevIP, prevPort := p.IP, p.Port
+	p.IP, p.Port = la.IP, la.Port
+	if p.Stale {
+		p.Stale = false
+		r.notify(PresenceEvent{Change: PresenceAdded, Lightpad: *p})
+		return
+	}
+	if !prevIP.Equal(la.IP) || prevPort != la.Port {
+		r.notify(PresenceEvent{
+			Change:       PresenceMoved,
+			Lightpad:     *p,
+			PreviousIP:   prevIP,
+			PreviousPort: prevPort,
+		})
+	}
+}
+
+// Expire marks lightpads that have missed too many heartbeats as stale. Run
+// calls it regularly.
+func (r *Registry) Expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deadline := r.now().Add(-r.timeout())
+	for _, lpid := range r.sortedLPIDs() {
+		p := r.pads[lpid]
+		if !p.Stale && p.LastSeen.Before(deadline) {
+			p.Stale = true
+			r.notify(PresenceEvent{Change: PresenceExpired, Lightpad: *p})
+		}
+	}
+}
+
+// SetLLID records the logical load a lightpad controls, as found from the Plum
+// web service, so it can be looked up by LLID
+func (r *Registry) SetLLID(lpid, llid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.llids[lpid] = llid
+	if p, ok := r.pads[lpid]; ok {
+		p.LLID = llid
+	}
+}
+
+// Lookup returns what is known about the lightpad
+func (r *Registry) Lookup(lpid string) (LightpadPresence, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pads[lpid]
+	if !ok {
+		return LightpadPresence{}, false
+	}
+	return *p, true
+}
+
+// LookupLLID returns the lightpads heard from that control the logical load,
+// sorted by LPID
+func (r *Registry) LookupLLID(llid string) []LightpadPresence {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []LightpadPresence
+	for _, lpid := range r.sortedLPIDs() {
+		if p := r.pads[lpid]; p.LLID == llid {
+			found = append(found, *p)
+		}
+	}
+	return found
+}
+
+// All returns every lightpad heard from, including stale ones, sorted by LPID
+func (r *Registry) All() []LightpadPresence {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := make([]LightpadPresence, 0, len(r.pads))
+	for _, lpid := range r.sortedLPIDs() {
+		all = append(all, *r.pads[lpid])
+	}
+	return all
+}
+
+// Subscribe returns a channel of changes to the registry until the context is
+// done, when it is closed. Changes are dropped if more than buffer (or
+// DefaultRegistryBuffer if buffer is less than 1) are waiting to be read.
+func (r *Registry) Subscribe(ctx context.Context, buffer int) <-chan PresenceEvent {
+	if buffer < 1 {
+		buffer = DefaultRegistryBuffer
+	}
+	ch := make(chan PresenceEvent, buffer)
+	r.mu.Lock()
+	r.subs[ch] = struct{}{}
+	r.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.subs, ch)
+		close(ch)
+	}()
+	return ch
+}
+
+// notify hands the event to every subscriber with room for it. r.mu must be
+// held.
+func (r *Registry) notify(ev PresenceEvent) {
+	for ch := range r.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// sortedLPIDs gives a stable order for notifications. r.mu must be held.
+func (r *Registry) sortedLPIDs() []string {
+	lpids := make([]string, 0, len(r.pads))
+	for lpid := range r.pads {
+		lpids = append(lpids, lpid)
+	}
+	sort.Strings(lpids)
+	return lpids
+}
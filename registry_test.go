@@ -0,0 +1,111 @@
+package libplumraw
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func nextPresence(t *testing.T, ch <-chan PresenceEvent) PresenceEvent {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for presence event")
+	}
+	return PresenceEvent{}
+}
+
+func TestRegistry(t *testing.T) {
+	clock := newFakeClock()
+	r := NewRegistry(RegistryConfig{Interval: time.Minute, MissedHeartbeats: 2})
+	r.now = clock.now
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := r.Subscribe(ctx, 0)
+	r.SetLLID("pad1", "load1")
+
+	ip1 := net.ParseIP("192.168.1.91")
+	r.Observe(LightpadAnnouncement{ID: "pad1", IP: ip1, Port: 8443})
+	ev := nextPresence(t, changes)
+	assert.Equal(t, PresenceAdded, ev.Change)
+	assert.Equal(t, "load1", ev.Lightpad.LLID)
+	first := clock.t
+
+	// the same heartbeat again changes nothing but when it was last seen
+	clock.advance(time.Minute)
+	r.Observe(LightpadAnnouncement{ID: "pad1", IP: ip1, Port: 8443})
+	r.Observe(LightpadAnnouncement{ID: "pad2", IP: net.ParseIP("192.168.1.92"), Port: 8443})
+	assert.Equal(t, "pad2", nextPresence(t, changes).Lightpad.LPID)
+	r.SetLLID("pad2", "load1")
+
+	p, ok := r.Lookup("pad1")
+	assert.True(t, ok)
+	assert.Equal(t, first, p.FirstSeen)
+	assert.Equal(t, clock.t, p.LastSeen)
+	assert.Len(t, r.LookupLLID("load1"), 2)
+	_, ok = r.Lookup("pad3")
+	assert.False(t, ok)
+
+	// pad1 gets a new address from DHCP
+	ip2 := net.ParseIP("192.168.1.191")
+	r.Observe(LightpadAnnouncement{ID: "pad1", IP: ip2, Port: 8443})
+	ev = nextPresence(t, changes)
+	assert.Equal(t, PresenceMoved, ev.Change)
+	assert.Equal(t, ip2, ev.Lightpad.IP)
+	assert.Equal(t, ip1, ev.PreviousIP)
+
+	// pad2 goes quiet for two heartbeats
+	clock.advance(90 * time.Second)
+	r.Observe(LightpadAnnouncement{ID: "pad1", IP: ip2, Port: 8443})
+	r.Expire()
+	select {
+	case ev := <-changes:
+		t.Fatalf("unexpected change %v", ev)
+	default:
+	}
+	clock.advance(31 * time.Second)
+	r.Expire()
+	ev = nextPresence(t, changes)
+	assert.Equal(t, PresenceExpired, ev.Change)
+	assert.Equal(t, "pad2", ev.Lightpad.LPID)
+	p, _ = r.Lookup("pad2")
+	assert.True(t, p.Stale)
+	r.Expire()
+	assert.Len(t, r.All(), 2)
+
+	// and comes back
+	r.Observe(LightpadAnnouncement{ID: "pad2", IP: net.ParseIP("192.168.1.92"), Port: 8443})
+	ev = nextPresence(t, changes)
+	assert.Equal(t, PresenceAdded, ev.Change)
+	assert.False(t, ev.Lightpad.Stale)
+
+	cancel()
+	for range changes {
+	}
+	assert.Equal(t, "expired", PresenceExpired.String())
+}
+
+func TestRegistryRun(t *testing.T) {
+	r := NewRegistry(RegistryConfig{Interval: 5 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := r.Subscribe(ctx, 0)
+	done := make(chan error)
+	hb := &TestLightpadHeartbeat{
+		LightpadAnnouncement: LightpadAnnouncement{ID: "pad1", IP: net.ParseIP("10.0.0.2"), Port: 8443},
+		Interval:             time.Millisecond,
+	}
+	go func() { done <- r.Run(ctx, hb) }()
+	assert.Equal(t, PresenceAdded, nextPresence(t, changes).Change)
+	cancel()
+	assert.NoError(t, <-done)
+
+	// a listener that fails is reported
+	hbErr := errors.New("port in use")
+	hb.Error = &hbErr
+	assert.Equal(t, hbErr, r.Run(context.Background(), hb))
+}
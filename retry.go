@@ -0,0 +1,140 @@
+package libplumraw
+
+// retry.go retries calls to the Plum web service and to lightpads that fail
+// with a transient error.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultRetryInitialBackoff is how long to wait before the first retry
+	// when a RetryPolicy doesn't say
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+	// DefaultRetryMaxBackoff is the longest wait between attempts when a
+	// RetryPolicy doesn't say
+	DefaultRetryMaxBackoff = 5 * time.Second
+	// DefaultRetryMultiplier is how much the wait grows after each attempt
+	// when a RetryPolicy doesn't say
+	DefaultRetryMultiplier = 2.0
+)
+
+// RetryPolicy controls how calls that fail with a transient error are retried.
+// Only calls that are safe to repeat are retried; creating and deleting scenes
+// are always tried just once. A nil *RetryPolicy never retries.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a call will be tried, including the first.
+	// Less than 2 means calls are not retried.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. Zero means
+	// DefaultRetryInitialBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts. Zero means
+	// DefaultRetryMaxBackoff.
+	MaxBackoff time.Duration
+	// Multiplier is how much the wait grows after each attempt. Less than 1
+	// means DefaultRetryMultiplier.
+	Multiplier float64
+	// Jitter is the fraction (0-1) of each wait that is randomized so many
+	// clients don't retry in lock step. 0.5 waits between half and all of the
+	// backoff.
+	Jitter float64
+	// Retryable decides whether an error is worth another attempt. Nil means
+	// IsRetryable.
+	Retryable func(error) bool
+}
+
+// RetryError is returned when a call made with a RetryPolicy fails. Err is the
+// error from the last attempt.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	if e.Attempts == 1 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("failed after %d attempts: %s", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error { return e.Err }
+
+// IsRetryable is true for errors that are likely to go away on their own:
+// throttling, server errors, timeouts and requests that got no response. A
+// call cancelled through its context is never retryable.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrThrottled) || errors.Is(err, ErrServer) {
+		return true
+	}
+	var re *RequestError
+	return errors.As(err, &re)
+}
+
+// do calls call until it succeeds, fails with an error that isn't retryable,
+// runs out of attempts or the context is done, waiting between attempts. Calls
+// that aren't idempotent are made only once. If p is nil or the call is not
+// idempotent, call's error is returned untouched; otherwise it is wrapped in a
+// *RetryError.
+func (p *RetryPolicy) do(ctx context.Context, idempotent bool, call func(context.Context) error) error {
+	if p == nil || !idempotent {
+		return call(ctx)
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	for attempt := 1; ; attempt++ {
+		err := call(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt >= p.MaxAttempts || !retryable(err) || ctx.Err() != nil {
+			return &RetryError{Attempts: attempt, Err: err}
+		}
+		t := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return &RetryError{Attempts: attempt, Err: err}
+		case <-t.C:
+		}
+	}
+}
+
+// backoff is how long to wait after the given attempt failed
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.InitialBackoff
+	if wait <= 0 {
+		wait = DefaultRetryInitialBackoff
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = DefaultRetryMaxBackoff
+	}
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = DefaultRetryMultiplier
+	}
+	for i := 1; i < attempt && wait < max; i++ {
+		wait = time.Duration(float64(wait) * mult)
+	}
+	if wait > max {
+		wait = max
+	}
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		wait -= time.Duration(rand.Float64() * jitter * float64(wait))
+	}
+	return wait
+}
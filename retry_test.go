@@ -0,0 +1,113 @@
+package libplumraw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testRetryPolicy = &RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	Jitter:         0.5,
+}
+
+func TestWebRetry(t *testing.T) {
+	// fail twice then succeed
+	var calls int32
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprintln(w, `{"rid":"roomid1"}`)
+	})
+	ts := httptest.NewServer(hf)
+	defer ts.Close()
+	wc := NewWebConnection(WebConnectionConfig{PlumAPIURL: ts.URL, Retry: testRetryPolicy})
+	room, err := wc.GetRoom(context.Background(), "roomid1")
+	assert.NoError(t, err)
+	assert.Equal(t, "roomid1", room.ID)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// always failing runs out of attempts
+	atomic.StoreInt32(&calls, -10)
+	_, err = wc.GetRoom(context.Background(), "roomid1")
+	re := &RetryError{}
+	if assert.True(t, errors.As(err, &re)) {
+		assert.Equal(t, 3, re.Attempts)
+	}
+	assert.True(t, errors.Is(err, ErrServer))
+
+	// creating a scene isn't safe to repeat
+	atomic.StoreInt32(&calls, 0)
+	_, err = wc.CreateScene(context.Background(), Scene{HouseID: "houseid1"})
+	assert.True(t, errors.Is(err, ErrServer))
+	assert.False(t, errors.As(err, &re))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestWebRetryNotRetryable(t *testing.T) {
+	var calls int32
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(401)
+	})
+	ts := httptest.NewServer(hf)
+	defer ts.Close()
+	wc := NewWebConnection(WebConnectionConfig{PlumAPIURL: ts.URL, Retry: testRetryPolicy})
+	err := wc.RenameRoom(context.Background(), "roomid1", "attic")
+	re := &RetryError{}
+	if assert.True(t, errors.As(err, &re)) {
+		assert.Equal(t, 1, re.Attempts)
+	}
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestLightpadRetry(t *testing.T) {
+	// the first attempt is dropped, the second gets through
+	var calls int32
+	done := make(chan struct{})
+	defer close(done)
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			select {
+			case <-done:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.WriteHeader(204)
+	})
+	pad := newMockLightpad(hf)
+	pad.Timeout = 200 * time.Millisecond
+	pad.Retry = testRetryPolicy
+	err := pad.SetLogicalLoadLevel(context.Background(), 200)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	}
+	assert.Equal(t, 10*time.Millisecond, p.backoff(1))
+	assert.Equal(t, 20*time.Millisecond, p.backoff(2))
+	assert.Equal(t, 40*time.Millisecond, p.backoff(3))
+	assert.Equal(t, 50*time.Millisecond, p.backoff(4))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		b := p.backoff(1)
+		assert.True(t, b > 5*time.Millisecond && b <= 10*time.Millisecond, "%s", b)
+	}
+}
@@ -0,0 +1,198 @@
+package libplumraw
+
+// scene.go runs a Scene by talking straight to the lightpads, without going
+// through the Plum web service.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultSceneRampStep is how often the level is changed while fading a load
+// when SceneOptions doesn't say
+const DefaultSceneRampStep = 100 * time.Millisecond
+
+// LoadController is the part of a Lightpad needed to run a scene
+type LoadController interface {
+	SetLogicalLoadLevel(ctx context.Context, level int) error
+	GetLogicalLoadMetrics(ctx context.Context) (LogicalLoadMetrics, error)
+}
+
+// LightpadResolver finds a lightpad that controls a logical load. Any one of
+// the lightpads sharing an LLID will do.
+type LightpadResolver interface {
+	LightpadForLLID(llid string) (LoadController, error)
+}
+
+// LightpadResolverFunc lets an ordinary function be used as a
+// LightpadResolver
+type LightpadResolverFunc func(llid string) (LoadController, error)
+
+func (f LightpadResolverFunc) LightpadForLLID(llid string) (LoadController, error) {
+	return f(llid)
+}
+
+// SceneOptions controls how ActivateScene applies a scene
+type SceneOptions struct {
+	// Concurrency limits how many loads are changed at once. Less than 1 means
+	// all of them.
+	Concurrency int
+	// RampStep is how often the level is changed while fading. Zero means
+	// DefaultSceneRampStep. The steps are spread evenly so the last lands
+	// when the fade ends. A fade shorter than two steps can't be ramped and
+	// is applied straight away, as if it had no fade.
+	RampStep time.Duration
+	// NoFade sets each load straight to its level, ignoring the scene's fade
+	// times.
+	NoFade bool
+
+	// now and newTimer are replaced in tests
+	now      func() time.Time
+	newTimer func(time.Duration) stepTimer
+}
+
+// stepTimer times the waits between a fade's steps. Outside tests it's a
+// *time.Timer.
+type stepTimer interface {
+	Chan() <-chan time.Time
+	Reset(time.Duration) bool
+	Stop() bool
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) Chan() <-chan time.Time { return t.C }
+
+func newRealTimer(d time.Duration) stepTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// SceneLoadResult is what happened to one load in the scene
+type SceneLoadResult struct {
+	LLID  string
+	Level int
+	// Steps is how many times the level was set; more than one when fading
+	Steps int
+	// Duration is how long it took to get the load to its level (or fail)
+	Duration time.Duration
+	Err      error
+}
+
+// SceneReport is the outcome of activating a scene, with one result per
+// setting in the scene, in the same order
+type SceneReport struct {
+	SceneID string
+	Results []SceneLoadResult
+}
+
+// Err returns nil if every load was set, otherwise an error describing each
+// load that failed
+func (r SceneReport) Err() error {
+	var errs []error
+	for _, res := range r.Results {
+		if res.Err != nil {
+			errs = append(errs, fmt.Errorf("load %s: %w", res.LLID, res.Err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("scene %s: %w", r.SceneID, errors.Join(errs...))
+}
+
+// ActivateScene sets every load in the scene to its level, all at once. Loads
+// with a fade time are ramped from their current level to the new one over
+// that time, since lightpads have no way to be told to fade. Cancelling the
+// context stops loads part way through their fade.
+func ActivateScene(ctx context.Context, scene Scene, resolver LightpadResolver, opts SceneOptions) SceneReport {
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+	if opts.newTimer == nil {
+		opts.newTimer = newRealTimer
+	}
+	report := SceneReport{
+		SceneID: scene.ID,
+		Results: make([]SceneLoadResult, len(scene.Settings)),
+	}
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = len(scene.Settings)
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, setting := range scene.Settings {
+		wg.Add(1)
+		go func(i int, setting SceneSettings) {
+			defer wg.Done()
+			res := &report.Results[i]
+			res.LLID = setting.LLID
+			res.Level = setting.Level
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				res.Err = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			start := opts.now()
+			res.Steps, res.Err = applySetting(ctx, setting, resolver, opts)
+			res.Duration = opts.now().Sub(start)
+		}(i, setting)
+	}
+	wg.Wait()
+	return report
+}
+
+// applySetting gets one load to its level, returning how many times the level
+// was set successfully
+func applySetting(ctx context.Context, setting SceneSettings, resolver LightpadResolver, opts SceneOptions) (int, error) {
+	pad, err := resolver.LightpadForLLID(setting.LLID)
+	if err != nil {
+		return 0, err
+	}
+	step := opts.RampStep
+	if step <= 0 {
+		step = DefaultSceneRampStep
+	}
+	fade := time.Duration(setting.Fade) * time.Millisecond
+	// without the current level there's nothing to fade from
+	var metrics LogicalLoadMetrics
+	if !opts.NoFade && fade >= 2*step {
+		metrics, err = pad.GetLogicalLoadMetrics(ctx)
+	}
+	if opts.NoFade || fade < 2*step || err != nil {
+		if err := pad.SetLogicalLoadLevel(ctx, setting.Level); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	from := metrics.Level
+	steps := int(fade / step)
+	// the load is already at from, so wait before each step, aiming at the
+	// step's place in the fade so the last lands as it ends
+	start := opts.now()
+	timer := opts.newTimer(fade / time.Duration(steps))
+	defer timer.Stop()
+	for i := 1; i <= steps; i++ {
+		if i > 1 {
+			due := start.Add(fade * time.Duration(i) / time.Duration(steps))
+			timer.Reset(due.Sub(opts.now()))
+		}
+		select {
+		case <-ctx.Done():
+			return i - 1, ctx.Err()
+		case <-timer.Chan():
+		}
+		level := from + (setting.Level-from)*i/steps
+		if err := pad.SetLogicalLoadLevel(ctx, level); err != nil {
+			return i - 1, err
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,154 @@
+package libplumraw
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// levelRecorder is a Lightpad that remembers every level it is set to, and
+// when if it has a clock
+type levelRecorder struct {
+	TestLightpad
+	mu     sync.Mutex
+	levels []int
+	clock  *sceneClock
+	times  []time.Time
+}
+
+// sceneClock lets tests run fades without waiting: its timers move the clock
+// on and fire straight away
+type sceneClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *sceneClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *sceneClock) newTimer(d time.Duration) stepTimer {
+	t := &sceneTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+type sceneTimer struct {
+	clock *sceneClock
+	c     chan time.Time
+}
+
+func (t *sceneTimer) Chan() <-chan time.Time { return t.c }
+func (t *sceneTimer) Stop() bool             { return false }
+
+func (t *sceneTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	t.clock.t = t.clock.t.Add(d)
+	now := t.clock.t
+	t.clock.mu.Unlock()
+	t.c <- now
+	return false
+}
+
+func (l *levelRecorder) SetLogicalLoadLevel(ctx context.Context, level int) error {
+	if err := l.err(ctx); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.levels = append(l.levels, level)
+	if l.clock != nil {
+		l.times = append(l.times, l.clock.now())
+	}
+	return nil
+}
+
+func TestActivateScene(t *testing.T) {
+	pads := map[string]*levelRecorder{
+		"load1": {},
+		"load2": {TestLightpad: TestLightpad{LogicalLoadMetrics: LogicalLoadMetrics{Level: 0}}},
+	}
+	resolver := LightpadResolverFunc(func(llid string) (LoadController, error) {
+		if pad, ok := pads[llid]; ok {
+			return pad, nil
+		}
+		return nil, errNoSuchThing
+	})
+	scene := Scene{
+		ID: "scene1",
+		Settings: []SceneSettings{
+			{LLID: "load1", Level: 255},
+			{LLID: "load2", Level: 200, Fade: 40},
+			{LLID: "load-gone", Level: 10},
+		},
+	}
+	report := ActivateScene(context.Background(), scene, resolver, SceneOptions{RampStep: 10 * time.Millisecond})
+
+	assert.Equal(t, "scene1", report.SceneID)
+	assert.Len(t, report.Results, 3)
+	assert.Equal(t, []int{255}, pads["load1"].levels)
+	assert.Equal(t, 1, report.Results[0].Steps)
+	assert.NoError(t, report.Results[0].Err)
+
+	// the faded load ramps up in steps
+	assert.Equal(t, []int{50, 100, 150, 200}, pads["load2"].levels)
+	assert.Equal(t, 4, report.Results[1].Steps)
+	assert.True(t, report.Results[1].Duration >= 40*time.Millisecond)
+
+	assert.Equal(t, "load-gone", report.Results[2].LLID)
+	assert.Equal(t, errNoSuchThing, report.Results[2].Err)
+	assert.True(t, errors.Is(report.Err(), errNoSuchThing))
+}
+
+func TestActivateSceneNoFade(t *testing.T) {
+	pad := &levelRecorder{}
+	resolver := LightpadResolverFunc(func(llid string) (LoadController, error) {
+		return pad, nil
+	})
+	scene := Scene{
+		ID:       "scene1",
+		Settings: []SceneSettings{{LLID: "load1", Level: 128, Fade: 10000}},
+	}
+	report := ActivateScene(context.Background(), scene, resolver, SceneOptions{NoFade: true})
+	assert.NoError(t, report.Err())
+	assert.Equal(t, []int{128}, pad.levels)
+}
+
+func TestActivateSceneFadeTiming(t *testing.T) {
+	clock := &sceneClock{t: time.Unix(1500000000, 0)}
+	start := clock.now()
+	pad := &levelRecorder{clock: clock}
+	resolver := LightpadResolverFunc(func(llid string) (LoadController, error) {
+		return pad, nil
+	})
+	opts := SceneOptions{RampStep: 300 * time.Millisecond, now: clock.now, newTimer: clock.newTimer}
+
+	// the steps are spread out so the last lands as the fade ends
+	scene := Scene{
+		ID:       "scene1",
+		Settings: []SceneSettings{{LLID: "load1", Level: 90, Fade: 1000}},
+	}
+	report := ActivateScene(context.Background(), scene, resolver, opts)
+	assert.NoError(t, report.Err())
+	assert.Equal(t, []int{30, 60, 90}, pad.levels)
+	var offsets []time.Duration
+	for _, at := range pad.times {
+		offsets = append(offsets, at.Sub(start))
+	}
+	assert.Equal(t, []time.Duration{333333333, 666666666, time.Second}, offsets)
+	assert.Equal(t, time.Second, report.Results[0].Duration)
+
+	// a fade shorter than two steps is a jump
+	pad.levels = nil
+	scene.Settings[0].Fade = 500
+	report = ActivateScene(context.Background(), scene, resolver, opts)
+	assert.NoError(t, report.Err())
+	assert.Equal(t, []int{90}, pad.levels)
+	assert.Equal(t, time.Duration(0), report.Results[0].Duration)
+}
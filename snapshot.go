@@ -0,0 +1,267 @@
+package libplumraw
+
+// snapshot.go saves everything the Plum web service knows about an account to
+// a file and serves it back as a WebConnection, so a controller can start up
+// while the web service is unreachable.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by this
+// library. Snapshots with a newer version can't be read.
+const SnapshotVersion = 1
+
+// ErrReadOnly is returned by calls that would change a snapshot
+var ErrReadOnly = errors.New("snapshot is read only")
+
+// Snapshot is everything in an account at the time it was taken. House access
+// tokens are included in the Houses, so treat snapshot files as secrets.
+type Snapshot struct {
+	Version      int            `json:"version"`
+	CreatedAt    time.Time      `json:"created_at"`
+	Houses       []House        `json:"houses"`
+	Rooms        []Room         `json:"rooms"`
+	LogicalLoads []LogicalLoad  `json:"logical_loads"`
+	Lightpads    []LightpadSpec `json:"lightpads"`
+	Scenes       []Scene        `json:"scenes"`
+}
+
+// ExportSnapshot fetches every house in the account with FetchHouseTopology.
+// If some objects couldn't be fetched, the snapshot of everything that could
+// is returned along with the errors describing what is missing.
+func ExportSnapshot(ctx context.Context, wc WebConnection, concurrency int) (*Snapshot, error) {
+	hids, err := wc.GetHouses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{
+		Version:   SnapshotVersion,
+		CreatedAt: time.Now().UTC(),
+	}
+	var errs []error
+	for _, hid := range hids {
+		topo, err := FetchHouseTopology(ctx, wc, hid, concurrency)
+		if topo == nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		snap.add(topo)
+	}
+	return snap, errors.Join(errs...)
+}
+
+func (s *Snapshot) add(topo *HouseTopology) {
+	s.Houses = append(s.Houses, topo.House)
+	for _, rt := range topo.Rooms {
+		s.Rooms = append(s.Rooms, rt.Room)
+		for _, lt := range rt.LogicalLoads {
+			s.LogicalLoads = append(s.LogicalLoads, lt.LogicalLoad)
+			s.Lightpads = append(s.Lightpads, lt.Lightpads...)
+		}
+	}
+	s.Scenes = append(s.Scenes, topo.Scenes...)
+}
+
+// Write encodes the snapshot as JSON
+func (s *Snapshot) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// Save writes the snapshot to a file. The file is replaced atomically, so a
+// crash part way through leaves the previous snapshot intact.
+func (s *Snapshot) Save(filename string) error {
+	return writeFileAtomic(filename, s.Write)
+}
+
+// writeFileAtomic replaces filename with what write produces. The file is
+// only readable by its owner since it may hold house access tokens.
+func writeFileAtomic(filename string, write func(io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// ReadSnapshot decodes a snapshot written by Snapshot.Write
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	snap := &Snapshot{}
+	err := json.NewDecoder(r).Decode(snap)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Version < 1 || snap.Version > SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	return snap, nil
+}
+
+// LoadSnapshot reads a snapshot from a file written by Snapshot.Save
+func LoadSnapshot(filename string) (*Snapshot, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSnapshot(f)
+}
+
+// SnapshotWebConnection implements WebConnection by answering every call from
+// a Snapshot. IDs that aren't in the snapshot get an error matching
+// ErrNotFound, and calls that would change anything return ErrReadOnly.
+type SnapshotWebConnection struct {
+	snap   *Snapshot
+	houses map[string]House
+	rooms  map[string]Room
+	loads  map[string]LogicalLoad
+	pads   map[string]LightpadSpec
+	scenes map[string]Scene
+}
+
+// NewSnapshotWebConnection indexes the snapshot. The snapshot must not be
+// changed afterwards.
+func NewSnapshotWebConnection(snap *Snapshot) *SnapshotWebConnection {
+	s := &SnapshotWebConnection{
+		snap:   snap,
+		houses: make(map[string]House, len(snap.Houses)),
+		rooms:  make(map[string]Room, len(snap.Rooms)),
+		loads:  make(map[string]LogicalLoad, len(snap.LogicalLoads)),
+		pads:   make(map[string]LightpadSpec, len(snap.Lightpads)),
+		scenes: make(map[string]Scene, len(snap.Scenes)),
+	}
+	for _, h := range snap.Houses {
+		s.houses[h.ID] = h
+	}
+	for _, r := range snap.Rooms {
+		s.rooms[r.ID] = r
+	}
+	for _, ll := range snap.LogicalLoads {
+		s.loads[ll.ID] = ll
+	}
+	for _, lp := range snap.Lightpads {
+		s.pads[lp.ID] = lp
+	}
+	for _, sc := range snap.Scenes {
+		s.scenes[sc.ID] = sc
+	}
+	return s
+}
+
+func notInSnapshot(kind, id string) error {
+	return fmt.Errorf("%s %s is not in the snapshot: %w", kind, id, ErrNotFound)
+}
+
+func (s *SnapshotWebConnection) GetHouses(ctx context.Context) (Houses, error) {
+	hids := make(Houses, 0, len(s.snap.Houses))
+	for _, h := range s.snap.Houses {
+		hids = append(hids, h.ID)
+	}
+	return hids, nil
+}
+
+func (s *SnapshotWebConnection) GetHouse(ctx context.Context, hid string) (House, error) {
+	h, ok := s.houses[hid]
+	if !ok {
+		return House{}, notInSnapshot("house", hid)
+	}
+	return h, nil
+}
+
+func (s *SnapshotWebConnection) GetScenes(ctx context.Context, hid string) (Scenes, error) {
+	if _, ok := s.houses[hid]; !ok {
+		return nil, notInSnapshot("house", hid)
+	}
+	sids := make(Scenes, 0)
+	for _, sc := range s.snap.Scenes {
+		if sc.HouseID == hid {
+			sids = append(sids, sc.ID)
+		}
+	}
+	return sids, nil
+}
+
+func (s *SnapshotWebConnection) GetScene(ctx context.Context, sid string) (Scene, error) {
+	sc, ok := s.scenes[sid]
+	if !ok {
+		return Scene{}, notInSnapshot("scene", sid)
+	}
+	return sc, nil
+}
+
+func (s *SnapshotWebConnection) GetRoom(ctx context.Context, rid string) (Room, error) {
+	r, ok := s.rooms[rid]
+	if !ok {
+		return Room{}, notInSnapshot("room", rid)
+	}
+	return r, nil
+}
+
+func (s *SnapshotWebConnection) GetLogicalLoad(ctx context.Context, llid string) (LogicalLoad, error) {
+	ll, ok := s.loads[llid]
+	if !ok {
+		return LogicalLoad{}, notInSnapshot("logical load", llid)
+	}
+	return ll, nil
+}
+
+func (s *SnapshotWebConnection) GetLightpad(ctx context.Context, lpid string) (LightpadSpec, error) {
+	lp, ok := s.pads[lpid]
+	if !ok {
+		return LightpadSpec{}, notInSnapshot("lightpad", lpid)
+	}
+	return lp, nil
+}
+
+func (s *SnapshotWebConnection) CreateScene(ctx context.Context, scene Scene) (Scene, error) {
+	return Scene{}, ErrReadOnly
+}
+
+func (s *SnapshotWebConnection) UpdateScene(ctx context.Context, scene Scene) error {
+	return ErrReadOnly
+}
+
+func (s *SnapshotWebConnection) DeleteScene(ctx context.Context, sid string) error {
+	return ErrReadOnly
+}
+
+func (s *SnapshotWebConnection) RenameRoom(ctx context.Context, rid, name string) error {
+	return ErrReadOnly
+}
+
+func (s *SnapshotWebConnection) RenameLogicalLoad(ctx context.Context, llid, name string) error {
+	return ErrReadOnly
+}
+
+func (s *SnapshotWebConnection) RenameLightpad(ctx context.Context, lpid, name string) error {
+	return ErrReadOnly
+}
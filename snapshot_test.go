@@ -0,0 +1,91 @@
+package libplumraw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	wc := newMapWebConnection()
+	wc.Houses = Houses{"house1"}
+	house := wc.houses["house1"]
+	house.AccessToken = "house-access-token"
+	wc.houses["house1"] = house
+
+	snap, err := ExportSnapshot(ctx, wc, 2)
+	// the missing room and lightpad are reported but the rest is exported
+	pfe := &PartialFetchError{}
+	assert.True(t, errors.As(err, &pfe))
+	assert.Len(t, snap.Rooms, 2)
+	assert.Len(t, snap.LogicalLoads, 3)
+	assert.Len(t, snap.Lightpads, 3)
+	assert.Len(t, snap.Scenes, 1)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, snap.Write(buf))
+	snap, err = ReadSnapshot(buf)
+	assert.NoError(t, err)
+
+	swc := NewSnapshotWebConnection(snap)
+	hids, err := swc.GetHouses(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Houses{"house1"}, hids)
+	h, err := swc.GetHouse(ctx, "house1")
+	assert.NoError(t, err)
+	assert.Equal(t, house, h)
+	room, err := swc.GetRoom(ctx, "room2")
+	assert.NoError(t, err)
+	assert.Equal(t, wc.rooms["room2"], room)
+	ll, err := swc.GetLogicalLoad(ctx, "load1")
+	assert.NoError(t, err)
+	assert.Equal(t, wc.loads["load1"], ll)
+	lp, err := swc.GetLightpad(ctx, "pad3")
+	assert.NoError(t, err)
+	assert.Equal(t, wc.pads["pad3"], lp)
+	sids, err := swc.GetScenes(ctx, "house1")
+	assert.NoError(t, err)
+	assert.Equal(t, Scenes{"scene1"}, sids)
+
+	_, err = swc.GetRoom(ctx, "room-gone")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, ErrReadOnly, swc.RenameRoom(ctx, "room1", "den"))
+
+	// the tree can be fetched straight from the snapshot, still missing what
+	// couldn't be exported
+	topo, err := FetchHouseTopology(ctx, swc, "house1", 0)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Len(t, topo.Rooms, 2)
+}
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libplumraw")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "plum.json")
+
+	snap := &Snapshot{
+		Version: SnapshotVersion,
+		Houses:  []House{{ID: "house1", AccessToken: "hat"}},
+	}
+	assert.NoError(t, snap.Save(filename))
+	loaded, err := LoadSnapshot(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, snap.Houses, loaded.Houses)
+
+	// nothing is left behind but the snapshot itself
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// snapshots from the future are refused
+	_, err = ReadSnapshot(bytes.NewBufferString(`{"version":99}`))
+	assert.Error(t, err)
+}
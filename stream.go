@@ -0,0 +1,186 @@
+package libplumraw
+
+// stream.go keeps a connection open to a lightpad's event stream, reconnecting
+// whenever it drops.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultStreamReconnectBackoff is the wait before the first attempt to
+	// reconnect a dropped event stream when the lightpad's Reconnect policy
+	// doesn't say
+	DefaultStreamReconnectBackoff = time.Second
+	// DefaultStreamReconnectMaxBackoff is the longest wait between attempts to
+	// reconnect when the lightpad's Reconnect policy doesn't say
+	DefaultStreamReconnectMaxBackoff = 30 * time.Second
+)
+
+// addressMu guards the IP and Port of every lightpad once it is in use; see
+// SetAddress. It is shared, rather than a field, so DefaultLightpad can still
+// be copied.
+var addressMu sync.Mutex
+
+// SetAddress changes where the lightpad is reached, for example after its
+// heartbeat shows it has a new IP. Calls made and stream connections opened
+// afterwards use the new address. Use this rather than setting IP and Port
+// directly once the lightpad is in use.
+func (l *DefaultLightpad) SetAddress(ip net.IP, port int) {
+	addressMu.Lock()
+	defer addressMu.Unlock()
+	l.IP = ip
+	l.Port = port
+}
+
+func (l *DefaultLightpad) address() (net.IP, int) {
+	addressMu.Lock()
+	defer addressMu.Unlock()
+	return l.IP, l.Port
+}
+
+func (l *DefaultLightpad) streamAddr() string {
+	ip, _ := l.address()
+	port := l.StreamPort
+	if port == 0 {
+		port = DefaultLightpadStreamPort
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// dialStream opens a connection to the event stream, giving up after the
+// lightpad's Timeout
+func (l *DefaultLightpad) dialStream(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := l.withTimeout(ctx)
+	defer cancel()
+	addr := l.streamAddr()
+	logrus.WithField("addr", addr).Debug("about to connect to lightpad")
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, &RequestError{Path: addr, ID: l.LLID, Err: err}
+	}
+	return conn, nil
+}
+
+// stream sends events from conn, and from each connection that replaces it,
+// until the context is done or the Reconnect policy runs out of attempts, then
+// closes events
+func (l *DefaultLightpad) stream(ctx context.Context, conn net.Conn, events chan<- Event) {
+	defer close(events)
+	src := &eventSource{lpid: l.ID, llid: l.LLID}
+	policy := l.Reconnect
+	if policy == nil {
+		policy = &RetryPolicy{
+			InitialBackoff: DefaultStreamReconnectBackoff,
+			MaxBackoff:     DefaultStreamReconnectMaxBackoff,
+		}
+	}
+	for {
+		addr := conn.RemoteAddr().String()
+		if !sendEvent(ctx, events, LPEConnected{src.base(Connected.String()), addr}) {
+			conn.Close()
+			return
+		}
+		err := readStream(ctx, conn, src, events)
+		conn.Close()
+		if ctx.Err() != nil {
+			logrus.WithField("lpid", l.ID).Debug("event stream cancelled")
+			return
+		}
+		logrus.WithField("lpid", l.ID).WithError(err).Debug("event stream dropped")
+		if !sendEvent(ctx, events, LPEDisconnected{src.base(Disconnected.String()), addr, err}) {
+			return
+		}
+		for attempt := 1; ; attempt++ {
+			t := time.NewTimer(policy.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			conn, err = l.dialStream(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+				logrus.WithField("lpid", l.ID).WithError(err).Warn("giving up reconnecting to lightpad")
+				sendEvent(ctx, events, LPEDisconnected{
+					src.base(Disconnected.String()),
+					l.streamAddr(),
+					&RetryError{Attempts: attempt, Err: err},
+				})
+				return
+			}
+		}
+	}
+}
+
+// readStream sends an event for each line read from conn until the connection
+// fails or the context is done, which closes conn
+func readStream(ctx context.Context, conn net.Conn, src *eventSource, events chan<- Event) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// a partial line at the end of the stream is dropped
+			return err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if !sendEvent(ctx, events, decodeEvent(src.base(""), line)) {
+			return ctx.Err()
+		}
+	}
+}
+
+// eventSource fills in the LightpadEvent for each event from one subscription
+type eventSource struct {
+	lpid string
+	llid string
+	seq  uint64
+}
+
+func (s *eventSource) base(typ string) LightpadEvent {
+	s.seq++
+	return LightpadEvent{
+		Type:          typ,
+		LightpadID:    s.lpid,
+		LogicalLoadID: s.llid,
+		Received:      time.Now(),
+		Sequence:      s.seq,
+	}
+}
+
+// sendEvent waits for room on the channel, returning false if the context
+// finished first
+func sendEvent(ctx context.Context, events chan<- Event, ev Event) bool {
+	select {
+	case events <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
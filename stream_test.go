@@ -0,0 +1,150 @@
+package libplumraw_test
+
+// The stream tests run against plumtest's fake stream server, which imports
+// libplumraw, so they live outside the package.
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maplebed/libplumraw"
+	"github.com/maplebed/libplumraw/plumtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStreamServer(t *testing.T) (*plumtest.StreamServer, *libplumraw.DefaultLightpad) {
+	srv := plumtest.NewStreamServer()
+	t.Cleanup(srv.Close)
+	pad := srv.Lightpad("lpid", "llid")
+	pad.Reconnect = &libplumraw.RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	return srv, pad
+}
+
+func nextEvent(t *testing.T, events <-chan libplumraw.Event) libplumraw.Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return nil
+}
+
+// waitForHangUp waits for every client of the server to disconnect
+func waitForHangUp(t *testing.T, srv *plumtest.StreamServer) {
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.Clients() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client never hung up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	srv, pad := newStreamServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := pad.Subscribe(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, srv.WaitForClients(1, 2*time.Second))
+
+	ev := nextEvent(t, events)
+	assert.Equal(t, libplumraw.Connected, ev.Kind())
+	assert.Equal(t, uint64(1), ev.Seq())
+	assert.Equal(t, "lpid", ev.LPID())
+	assert.Equal(t, "llid", ev.LLID())
+	assert.False(t, ev.Time().IsZero())
+	// two events in one write must both arrive
+	srv.PushLine("{\"type\":\"dimmerchange\",\"level\":128}.\n{\"type\":\"power\",\"watts\":12}.")
+	ev = nextEvent(t, events)
+	dc, ok := ev.(libplumraw.LPEDimmerChange)
+	assert.True(t, ok)
+	assert.Equal(t, 128, dc.Level)
+	assert.Equal(t, uint64(2), dc.Seq())
+	assert.Equal(t, "llid", dc.LLID())
+	assert.Equal(t, `{"type":"dimmerchange","level":128}`, string(dc.Raw()))
+	ev = nextEvent(t, events)
+	pw, ok := ev.(libplumraw.LPEPower)
+	assert.True(t, ok)
+	assert.Equal(t, 12, pw.Watts)
+	assert.Equal(t, uint64(3), pw.Seq())
+	// a line split across writes is put back together
+	srv.InjectGarbage([]byte("{\"type\":\"pirSi"))
+	time.Sleep(10 * time.Millisecond)
+	srv.PushLine("gnal\",\"signal\":3}")
+	ev = nextEvent(t, events)
+	pir, ok := ev.(libplumraw.LPEPIRSignal)
+	assert.True(t, ok)
+	assert.Equal(t, 3, pir.Signal)
+
+	// the pad reboots; the stream says so and reconnects
+	srv.Drop()
+	ev = nextEvent(t, events)
+	dis, ok := ev.(libplumraw.LPEDisconnected)
+	assert.True(t, ok)
+	assert.Error(t, dis.Err)
+	assert.NoError(t, srv.WaitForClients(2, 2*time.Second))
+	assert.Equal(t, libplumraw.Connected, nextEvent(t, events).Kind())
+	srv.PushLine("{\"type\":\"dimmerchange\",\"level\":0}")
+	ev = nextEvent(t, events)
+	assert.Equal(t, libplumraw.DimmerChange, ev.Kind())
+	assert.Equal(t, uint64(7), ev.Seq())
+
+	// cancelling closes the connection and the channel
+	cancel()
+	waitForHangUp(t, srv)
+	for range events {
+	}
+}
+
+func TestSubscribeGivesUp(t *testing.T) {
+	srv, pad := newStreamServer(t)
+	pad.Reconnect.MaxAttempts = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := pad.Subscribe(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, srv.WaitForClients(1, 2*time.Second))
+	assert.Equal(t, libplumraw.Connected, nextEvent(t, events).Kind())
+
+	// the pad goes away for good
+	srv.Close()
+	assert.Equal(t, libplumraw.Disconnected, nextEvent(t, events).Kind())
+	dis, ok := nextEvent(t, events).(libplumraw.LPEDisconnected)
+	assert.True(t, ok)
+	var re *libplumraw.RetryError
+	assert.True(t, errors.As(dis.Err, &re))
+	assert.Equal(t, 2, re.Attempts)
+	_, open := <-events
+	assert.False(t, open)
+}
+
+func TestSubscribeUnreachable(t *testing.T) {
+	srv, pad := newStreamServer(t)
+	srv.Close()
+	events, err := pad.Subscribe(context.Background())
+	assert.Nil(t, events)
+	var re *libplumraw.RequestError
+	assert.True(t, errors.As(err, &re))
+}
+
+func TestHubStream(t *testing.T) {
+	srv, pad := newStreamServer(t)
+	hub := libplumraw.NewHub()
+	defer hub.Close()
+	sub := hub.Subscribe(libplumraw.EventFilter{Kinds: []libplumraw.LightpadEventType{libplumraw.DimmerChange}}, 0)
+	err := hub.AddLightpad("lpid", pad)
+	assert.NoError(t, err)
+	assert.NoError(t, srv.WaitForClients(1, 2*time.Second))
+	srv.PushLine("{\"type\":\"power\",\"watts\":1}\n{\"type\":\"dimmerchange\",\"level\":9}")
+	ev := nextEvent(t, sub.Events())
+	assert.Equal(t, libplumraw.DimmerChange, ev.Kind())
+	assert.Equal(t, "lpid", ev.LPID())
+
+	// closing the hub hangs up on the lightpad
+	hub.Close()
+	waitForHangUp(t, srv)
+}
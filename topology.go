@@ -0,0 +1,241 @@
+package libplumraw
+
+// topology.go fetches a whole house from the Plum web service in one call,
+// linking the house to its rooms, the rooms to their logical loads and the
+// loads to their lightpads.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultFetchConcurrency is the number of calls FetchHouseTopology makes to
+// the web service at once when it isn't told otherwise.
+const DefaultFetchConcurrency = 4
+
+// HouseTopology is a house along with everything in it
+type HouseTopology struct {
+	House  House
+	Rooms  []RoomTopology
+	Scenes []Scene
+}
+
+// RoomTopology is a room along with the logical loads in it
+type RoomTopology struct {
+	Room         Room
+	LogicalLoads []LoadTopology
+}
+
+// LoadTopology is a logical load along with the lightpads that control it
+type LoadTopology struct {
+	LogicalLoad LogicalLoad
+	Lightpads   []LightpadSpec
+}
+
+// FetchFailure identifies one object that could not be fetched
+type FetchFailure struct {
+	// Kind is what sort of object it is: "room", "logical load", "lightpad",
+	// "scenes" (the list of scene IDs for a house) or "scene"
+	Kind string
+	ID   string
+	Err  error
+}
+
+// PartialFetchError is returned by FetchHouseTopology alongside the topology
+// when some of the house's objects could not be fetched. The topology contains
+// everything that was fetched successfully.
+type PartialFetchError struct {
+	HouseID  string
+	Failures []FetchFailure
+}
+
+func (e *PartialFetchError) Error() string {
+	fails := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		fails = append(fails, fmt.Sprintf("%s %s: %s", f.Kind, f.ID, f.Err))
+	}
+	return fmt.Sprintf("failed to fetch %d objects in house %s: %s",
+		len(e.Failures), e.HouseID, strings.Join(fails, "; "))
+}
+
+// Unwrap returns the errors of each of the failures
+func (e *PartialFetchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		errs = append(errs, f.Err)
+	}
+	return errs
+}
+
+// FetchHouseTopology fetches the house and then all of its rooms, logical
+// loads, lightpads and scenes, making at most concurrency calls to the web
+// service at a time (DefaultFetchConcurrency if concurrency is less than 1).
+//
+// If the house itself can't be fetched, its error is returned. If any of the
+// objects within it can't be fetched, the returned topology leaves them out and
+// the error is a *PartialFetchError listing them.
+func FetchHouseTopology(ctx context.Context, wc WebConnection, hid string, concurrency int) (*HouseTopology, error) {
+	house, err := wc.GetHouse(ctx, hid)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		concurrency = DefaultFetchConcurrency
+	}
+	f := &topologyFetcher{
+		ctx: ctx,
+		sem: make(chan struct{}, concurrency),
+	}
+
+	var (
+		rooms  = make(map[string]Room)
+		loads  = make(map[string]LogicalLoad)
+		pads   = make(map[string]LightpadSpec)
+		scenes = make(map[string]Scene)
+		sids   Scenes
+	)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		f.fetchAll("room", house.RoomIDs, func(ctx context.Context, rid string) error {
+			room, err := wc.GetRoom(ctx, rid)
+			if err == nil {
+				f.mu.Lock()
+				rooms[rid] = room
+				f.mu.Unlock()
+			}
+			return err
+		})
+		var llids IDs
+		for _, room := range rooms {
+			llids = append(llids, room.LLIDs...)
+		}
+		f.fetchAll("logical load", llids, func(ctx context.Context, llid string) error {
+			ll, err := wc.GetLogicalLoad(ctx, llid)
+			if err == nil {
+				f.mu.Lock()
+				loads[llid] = ll
+				f.mu.Unlock()
+			}
+			return err
+		})
+		var lpids IDs
+		for _, ll := range loads {
+			lpids = append(lpids, ll.LPIDs...)
+		}
+		f.fetchAll("lightpad", lpids, func(ctx context.Context, lpid string) error {
+			lp, err := wc.GetLightpad(ctx, lpid)
+			if err == nil {
+				f.mu.Lock()
+				pads[lpid] = lp
+				f.mu.Unlock()
+			}
+			return err
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		f.fetchAll("scenes", IDs{hid}, func(ctx context.Context, hid string) error {
+			var err error
+			sids, err = wc.GetScenes(ctx, hid)
+			return err
+		})
+		f.fetchAll("scene", IDs(sids), func(ctx context.Context, sid string) error {
+			scene, err := wc.GetScene(ctx, sid)
+			if err == nil {
+				f.mu.Lock()
+				scenes[sid] = scene
+				f.mu.Unlock()
+			}
+			return err
+		})
+	}()
+	wg.Wait()
+
+	// assemble the tree in the order the IDs were listed, leaving out anything
+	// that failed
+	topo := &HouseTopology{House: house}
+	for _, rid := range house.RoomIDs {
+		room, ok := rooms[rid]
+		if !ok {
+			continue
+		}
+		rt := RoomTopology{Room: room}
+		for _, llid := range room.LLIDs {
+			ll, ok := loads[llid]
+			if !ok {
+				continue
+			}
+			lt := LoadTopology{LogicalLoad: ll}
+			for _, lpid := range ll.LPIDs {
+				if lp, ok := pads[lpid]; ok {
+					lt.Lightpads = append(lt.Lightpads, lp)
+				}
+			}
+			rt.LogicalLoads = append(rt.LogicalLoads, lt)
+		}
+		topo.Rooms = append(topo.Rooms, rt)
+	}
+	for _, sid := range sids {
+		if scene, ok := scenes[sid]; ok {
+			topo.Scenes = append(topo.Scenes, scene)
+		}
+	}
+	if len(f.failures) > 0 {
+		sort.Slice(f.failures, func(i, j int) bool {
+			if f.failures[i].Kind != f.failures[j].Kind {
+				return f.failures[i].Kind < f.failures[j].Kind
+			}
+			return f.failures[i].ID < f.failures[j].ID
+		})
+		return topo, &PartialFetchError{HouseID: hid, Failures: f.failures}
+	}
+	return topo, nil
+}
+
+// topologyFetcher bounds the number of calls in flight and collects failures
+type topologyFetcher struct {
+	ctx      context.Context
+	sem      chan struct{}
+	mu       sync.Mutex
+	failures []FetchFailure
+}
+
+// fetchAll calls fetch once for each distinct ID and waits for all of them to
+// finish. Failures are recorded rather than returned.
+func (f *topologyFetcher) fetchAll(kind string, ids IDs, fetch func(context.Context, string) error) {
+	seen := make(map[string]bool, len(ids))
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			select {
+			case f.sem <- struct{}{}:
+			case <-f.ctx.Done():
+				f.fail(kind, id, f.ctx.Err())
+				return
+			}
+			err := fetch(f.ctx, id)
+			<-f.sem
+			if err != nil {
+				f.fail(kind, id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+func (f *topologyFetcher) fail(kind, id string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, FetchFailure{Kind: kind, ID: id, Err: err})
+}
@@ -0,0 +1,166 @@
+package libplumraw
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mapWebConnection serves objects by ID and counts how many calls are in
+// flight at once
+type mapWebConnection struct {
+	TestWebConnection
+	houses map[string]House
+	rooms  map[string]Room
+	loads  map[string]LogicalLoad
+	pads   map[string]LightpadSpec
+	scenes map[string]Scene
+
+	mu          sync.Mutex
+	calls       int
+	inFlight    int
+	maxInFlight int
+}
+
+var errNoSuchThing = errors.New("no such thing")
+
+func (m *mapWebConnection) track() func() {
+	m.mu.Lock()
+	m.calls++
+	m.inFlight++
+	if m.inFlight > m.maxInFlight {
+		m.maxInFlight = m.inFlight
+	}
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		m.inFlight--
+		m.mu.Unlock()
+	}
+}
+
+func (m *mapWebConnection) callCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+func (m *mapWebConnection) GetHouse(ctx context.Context, hid string) (House, error) {
+	defer m.track()()
+	if h, ok := m.houses[hid]; ok {
+		return h, nil
+	}
+	return House{}, errNoSuchThing
+}
+
+func (m *mapWebConnection) GetScenes(ctx context.Context, hid string) (Scenes, error) {
+	defer m.track()()
+	sids := Scenes{}
+	for sid, s := range m.scenes {
+		if s.HouseID == hid {
+			sids = append(sids, sid)
+		}
+	}
+	return sids, nil
+}
+
+func (m *mapWebConnection) GetScene(ctx context.Context, sid string) (Scene, error) {
+	defer m.track()()
+	if s, ok := m.scenes[sid]; ok {
+		return s, nil
+	}
+	return Scene{}, errNoSuchThing
+}
+
+func (m *mapWebConnection) GetRoom(ctx context.Context, rid string) (Room, error) {
+	defer m.track()()
+	if r, ok := m.rooms[rid]; ok {
+		return r, nil
+	}
+	return Room{}, errNoSuchThing
+}
+
+func (m *mapWebConnection) GetLogicalLoad(ctx context.Context, llid string) (LogicalLoad, error) {
+	defer m.track()()
+	if ll, ok := m.loads[llid]; ok {
+		return ll, nil
+	}
+	return LogicalLoad{}, errNoSuchThing
+}
+
+func (m *mapWebConnection) GetLightpad(ctx context.Context, lpid string) (LightpadSpec, error) {
+	defer m.track()()
+	if lp, ok := m.pads[lpid]; ok {
+		return lp, nil
+	}
+	return LightpadSpec{}, errNoSuchThing
+}
+
+func newMapWebConnection() *mapWebConnection {
+	return &mapWebConnection{
+		houses: map[string]House{
+			"house1": {ID: "house1", RoomIDs: IDs{"room1", "room2", "room-gone"}},
+		},
+		rooms: map[string]Room{
+			"room1": {ID: "room1", HouseID: "house1", LLIDs: IDs{"load1", "load2"}},
+			"room2": {ID: "room2", HouseID: "house1", LLIDs: IDs{"load3"}},
+		},
+		loads: map[string]LogicalLoad{
+			"load1": {ID: "load1", RoomID: "room1", LPIDs: IDs{"pad1", "pad2"}},
+			"load2": {ID: "load2", RoomID: "room1", LPIDs: IDs{"pad-gone"}},
+			"load3": {ID: "load3", RoomID: "room2", LPIDs: IDs{"pad3"}},
+		},
+		pads: map[string]LightpadSpec{
+			"pad1": {ID: "pad1", LLID: "load1"},
+			"pad2": {ID: "pad2", LLID: "load1"},
+			"pad3": {ID: "pad3", LLID: "load3"},
+		},
+		scenes: map[string]Scene{
+			"scene1": {ID: "scene1", HouseID: "house1", Name: "bright"},
+		},
+	}
+}
+
+func TestFetchHouseTopology(t *testing.T) {
+	wc := newMapWebConnection()
+	topo, err := FetchHouseTopology(context.Background(), wc, "house1", 2)
+
+	expect := &HouseTopology{
+		House: wc.houses["house1"],
+		Rooms: []RoomTopology{
+			{
+				Room: wc.rooms["room1"],
+				LogicalLoads: []LoadTopology{
+					{wc.loads["load1"], []LightpadSpec{wc.pads["pad1"], wc.pads["pad2"]}},
+					{wc.loads["load2"], nil},
+				},
+			},
+			{
+				Room: wc.rooms["room2"],
+				LogicalLoads: []LoadTopology{
+					{wc.loads["load3"], []LightpadSpec{wc.pads["pad3"]}},
+				},
+			},
+		},
+		Scenes: []Scene{wc.scenes["scene1"]},
+	}
+	assert.Equal(t, expect, topo)
+
+	// the missing room and lightpad are reported
+	pfe := &PartialFetchError{}
+	assert.True(t, errors.As(err, &pfe))
+	assert.Equal(t, []FetchFailure{
+		{"lightpad", "pad-gone", errNoSuchThing},
+		{"room", "room-gone", errNoSuchThing},
+	}, pfe.Failures)
+	assert.True(t, errors.Is(err, errNoSuchThing))
+	assert.True(t, wc.maxInFlight <= 2)
+
+	// a missing house is an outright failure
+	topo, err = FetchHouseTopology(context.Background(), wc, "house-gone", 2)
+	assert.Nil(t, topo)
+	assert.Equal(t, errNoSuchThing, err)
+}
@@ -4,6 +4,7 @@ package libplumraw
 import (
 	"net"
 	"net/http"
+	"time"
 )
 
 // Houses is a list of House IDs
@@ -89,11 +90,23 @@ type DefaultLightpad struct {
 	IP         net.IP       `json:"ip"`   // IP address of this lightpad
 	Port       int          `json:"port"` // port on which this lightpad listens
 	HAT        string       `json:"hat"`  // house access token
-	HttpClient *http.Client `json:"-"`
-
-	// StateChanges is a channel down which the lightpad will send state change
-	// events
-	StateChanges chan Event `json:"-"`
+	HttpClient *http.Client `json:"-"`    // nil means a shared client trusting the lightpad's certificate
+	// StreamPort is the port on which the lightpad sends events. Zero means
+	// DefaultLightpadStreamPort.
+	StreamPort int `json:"streamPort,omitempty"`
+	// Timeout bounds every call made to the lightpad. Zero means use
+	// DefaultLightpadTimeout; a negative value disables the timeout so only
+	// the context passed to each call applies.
+	Timeout time.Duration `json:"-"`
+	// Retry, if set, retries calls that fail with a transient error. All
+	// lightpad calls set absolute values so they are all safe to retry.
+	Retry *RetryPolicy `json:"-"`
+	// Reconnect sets the waits between attempts to reconnect the event stream
+	// after it drops. Nil means the stream is retried forever, backing off
+	// from DefaultStreamReconnectBackoff to DefaultStreamReconnectMaxBackoff.
+	// MaxAttempts, if set, is how many dials in a row may fail before the
+	// stream gives up. Retryable is ignored; every failure is retried.
+	Reconnect *RetryPolicy `json:"-"`
 }
 
 type LightpadConfig struct {
@@ -167,46 +180,6 @@ type LightpadMetric struct {
 	Power int `json:"power,omitempty"`
 }
 
-// TODO give lightpad events more structure instead of just a map[string]interface{}
-type LightpadEventType uint32
-
-const (
-	UndefEvent LightpadEventType = iota
-	DimmerChange
-	Power
-	PIRSignal
-	ConfigChange
-)
-
-// LightpadEvent is what's emitted from the lightpad when it changes state.
-// Examples: load change, PIR activated, etc.
-type Event interface{}
-
-type lightpadEvent struct {
-	Type  string
-	Error error
-}
-
-type LPEUnknown struct {
-	lightpadEvent
-	Message string
-}
-type LPEDimmerChange struct {
-	lightpadEvent
-	Level int
-}
-type LPEPower struct {
-	lightpadEvent
-	Watts int
-}
-type LPEPIRSignal struct {
-	lightpadEvent
-	Signal int
-}
-type LPEConfigChange struct {
-	lightpadEvent
-}
-
 type IDs []string
 
 // make a list of IDs sortable and comparable
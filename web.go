@@ -5,6 +5,7 @@ package libplumraw
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -14,35 +15,34 @@ import (
 	"strings"
 )
 
-func (c *defaultWebConnection) GetHouses() (Houses, error) {
-	resp, err := c.makePlumWebGETRequest(pathGetHouses)
+func (c *defaultWebConnection) GetHouses(ctx context.Context) (Houses, error) {
+	hids := make(Houses, 0, 0)
+	err := c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		resp, err := c.makePlumWebGETRequest(ctx, pathGetHouses)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		err = checkResponse(resp, pathGetHouses, "", http.StatusOK)
+		if err != nil {
+			return err
+		}
+		return decodeResponse(resp, pathGetHouses, "", &hids)
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to reach Plum: status %s", resp.Status)
-	}
-	hids := make(Houses, 0, 0)
-	// spew.Dump(resp)
-	json.NewDecoder(resp.Body).Decode(&hids)
 	return hids, nil
 }
 
-func (c *defaultWebConnection) GetHouse(hid string) (House, error) {
+func (c *defaultWebConnection) GetHouse(ctx context.Context, hid string) (House, error) {
 	postData := struct {
 		HID string `json:"hid"`
 	}{hid}
-	resp, err := c.makePlumWebPOSTRequest(pathGetHouse, postData)
-	if err != nil {
-		return House{}, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return House{}, fmt.Errorf("failed to reach Plum: status %s", resp.Status)
-	}
 	house := House{}
-	err = json.NewDecoder(resp.Body).Decode(&house)
+	err := c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathGetHouse, hid, postData, &house)
+	})
 	if err != nil {
 		return House{}, err
 	}
@@ -50,57 +50,42 @@ func (c *defaultWebConnection) GetHouse(hid string) (House, error) {
 	return house, nil
 }
 
-func (c *defaultWebConnection) GetScenes(hid string) (Scenes, error) {
+func (c *defaultWebConnection) GetScenes(ctx context.Context, hid string) (Scenes, error) {
 	postData := struct {
 		HID string `json:"hid"`
 	}{hid}
-	resp, err := c.makePlumWebPOSTRequest(pathGetScenes, postData)
+	sids := make(Scenes, 0, 0)
+	err := c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathGetScenes, hid, postData, &sids)
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to reach Plum: status %s", resp.Status)
-	}
-	sids := make(Scenes, 0, 0)
-	json.NewDecoder(resp.Body).Decode(&sids)
 	return sids, nil
 }
 
-func (c *defaultWebConnection) GetScene(sid string) (Scene, error) {
+func (c *defaultWebConnection) GetScene(ctx context.Context, sid string) (Scene, error) {
 	postData := struct {
 		SID string `json:"sid"`
 	}{sid}
-	resp, err := c.makePlumWebPOSTRequest(pathGetScene, postData)
-	if err != nil {
-		return Scene{}, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return Scene{}, fmt.Errorf("failed to reach Plum: status %s", resp.Status)
-	}
 	scene := Scene{}
-	err = json.NewDecoder(resp.Body).Decode(&scene)
+	err := c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathGetScene, sid, postData, &scene)
+	})
 	if err != nil {
 		return Scene{}, err
 	}
 	return scene, nil
 }
 
-func (c *defaultWebConnection) GetRoom(rid string) (Room, error) {
+func (c *defaultWebConnection) GetRoom(ctx context.Context, rid string) (Room, error) {
 	postData := struct {
 		RID string `json:"rid"`
 	}{rid}
-	resp, err := c.makePlumWebPOSTRequest(pathGetRoom, postData)
-	if err != nil {
-		return Room{}, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return Room{}, fmt.Errorf("failed to reach Plum: status %s", resp.Status)
-	}
 	room := Room{}
-	err = json.NewDecoder(resp.Body).Decode(&room)
+	err := c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathGetRoom, rid, postData, &room)
+	})
 	if err != nil {
 		return Room{}, err
 	}
@@ -108,20 +93,14 @@ func (c *defaultWebConnection) GetRoom(rid string) (Room, error) {
 	return room, nil
 }
 
-func (c *defaultWebConnection) GetLogicalLoad(llid string) (LogicalLoad, error) {
+func (c *defaultWebConnection) GetLogicalLoad(ctx context.Context, llid string) (LogicalLoad, error) {
 	postData := struct {
 		LLID string `json:"llid"`
 	}{llid}
-	resp, err := c.makePlumWebPOSTRequest(pathGetLogicalLoad, postData)
-	if err != nil {
-		return LogicalLoad{}, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return LogicalLoad{}, fmt.Errorf("failed to reach Plum: status %s", resp.Status)
-	}
 	ll := LogicalLoad{}
-	err = json.NewDecoder(resp.Body).Decode(&ll)
+	err := c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathGetLogicalLoad, llid, postData, &ll)
+	})
 	if err != nil {
 		return LogicalLoad{}, err
 	}
@@ -129,28 +108,113 @@ func (c *defaultWebConnection) GetLogicalLoad(llid string) (LogicalLoad, error)
 	return ll, nil
 }
 
-func (c *defaultWebConnection) GetLightpad(lpid string) (LightpadSpec, error) {
+func (c *defaultWebConnection) GetLightpad(ctx context.Context, lpid string) (LightpadSpec, error) {
 	postData := struct {
 		LPID string `json:"lpid"`
 	}{lpid}
-	resp, err := c.makePlumWebPOSTRequest(pathGetLightpad, postData)
+	lp := LightpadSpec{}
+	err := c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathGetLightpad, lpid, postData, &lp)
+	})
 	if err != nil {
 		return LightpadSpec{}, err
 	}
+	lp.ID = lpid
+	return lp, nil
+}
+
+// CreateScene adds a new scene to the house named by scene.HouseID. The
+// returned Scene carries the ID Plum assigned to it. It is never retried since
+// a retry could create a second scene.
+func (c *defaultWebConnection) CreateScene(ctx context.Context, scene Scene) (Scene, error) {
+	postData := struct {
+		HID      string          `json:"hid"`
+		Name     string          `json:"scene_name"`
+		Settings []SceneSettings `json:"settings"`
+	}{scene.HouseID, scene.Name, scene.Settings}
+	created := struct {
+		SID string `json:"sid"`
+	}{}
+	err := c.config.Retry.do(ctx, false, func(ctx context.Context) error {
+		return c.post(ctx, pathCreateScene, scene.HouseID, postData, &created)
+	})
+	if err != nil {
+		return Scene{}, err
+	}
+	scene.ID = created.SID
+	return scene, nil
+}
+
+// UpdateScene replaces the name and settings of the scene identified by
+// scene.ID
+func (c *defaultWebConnection) UpdateScene(ctx context.Context, scene Scene) error {
+	return c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathUpdateScene, scene.ID, scene, nil)
+	})
+}
+
+// DeleteScene removes a scene. It is never retried since a retry after a
+// delete that succeeded but whose response was lost would fail with
+// ErrNotFound.
+func (c *defaultWebConnection) DeleteScene(ctx context.Context, sid string) error {
+	postData := struct {
+		SID string `json:"sid"`
+	}{sid}
+	return c.config.Retry.do(ctx, false, func(ctx context.Context) error {
+		return c.post(ctx, pathDeleteScene, sid, postData, nil)
+	})
+}
+
+func (c *defaultWebConnection) RenameRoom(ctx context.Context, rid, name string) error {
+	postData := struct {
+		RID  string `json:"rid"`
+		Name string `json:"room_name"`
+	}{rid, name}
+	return c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathRenameRoom, rid, postData, nil)
+	})
+}
+
+func (c *defaultWebConnection) RenameLogicalLoad(ctx context.Context, llid, name string) error {
+	postData := struct {
+		LLID string `json:"llid"`
+		Name string `json:"logical_load_name"`
+	}{llid, name}
+	return c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathRenameLogicalLoad, llid, postData, nil)
+	})
+}
+
+func (c *defaultWebConnection) RenameLightpad(ctx context.Context, lpid, name string) error {
+	postData := struct {
+		LPID string `json:"lpid"`
+		Name string `json:"lightpad_name"`
+	}{lpid, name}
+	return c.config.Retry.do(ctx, true, func(ctx context.Context) error {
+		return c.post(ctx, pathRenameLightpad, lpid, postData, nil)
+	})
+}
+
+// post makes a single POST request and decodes the response into out. If out
+// is nil the response body is ignored and 204 No Content is accepted as well
+// as 200 OK.
+func (c *defaultWebConnection) post(ctx context.Context, urlPath, id string, postData, out interface{}) error {
+	resp, err := c.makePlumWebPOSTRequest(ctx, urlPath, id, postData)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return LightpadSpec{}, fmt.Errorf("failed to reach Plum: status %s", resp.Status)
+	if out == nil {
+		return checkResponse(resp, urlPath, id, http.StatusOK, http.StatusNoContent)
 	}
-	lp := LightpadSpec{}
-	err = json.NewDecoder(resp.Body).Decode(&lp)
+	err = checkResponse(resp, urlPath, id, http.StatusOK)
 	if err != nil {
-		return LightpadSpec{}, err
+		return err
 	}
-	lp.ID = lpid
-	return lp, nil
+	return decodeResponse(resp, urlPath, id, out)
 }
 
-func (c *defaultWebConnection) makePlumWebGETRequest(urlPath string) (*http.Response, error) {
+func (c *defaultWebConnection) makePlumWebGETRequest(ctx context.Context, urlPath string) (*http.Response, error) {
 	userAgent := fmt.Sprintf("%s/%s", DefaultUserAgent, Version)
 	if UserAgentAddition != "" {
 		userAgent = fmt.Sprintf("%s %s", userAgent, strings.TrimSpace(UserAgentAddition))
@@ -160,7 +224,7 @@ func (c *defaultWebConnection) makePlumWebGETRequest(urlPath string) (*http.Resp
 		return nil, err
 	}
 	api.Path = path.Join(api.Path, urlPath)
-	req, err := http.NewRequest("GET", api.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", api.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -169,10 +233,12 @@ func (c *defaultWebConnection) makePlumWebGETRequest(urlPath string) (*http.Resp
 	// spew.Dump(c.config)
 	req.SetBasicAuth(c.config.Email, c.config.Password)
 	// spew.Dump(req)
-	return c.HttpClient.Do(req)
+	return c.do(ctx, req, urlPath, "")
 }
 
-func (c *defaultWebConnection) makePlumWebPOSTRequest(urlPath string, postData interface{}) (*http.Response, error) {
+// makePlumWebPOSTRequest posts the JSON encoded postData to urlPath. id is the
+// ID of the object the request is about and is only used to describe errors.
+func (c *defaultWebConnection) makePlumWebPOSTRequest(ctx context.Context, urlPath, id string, postData interface{}) (*http.Response, error) {
 	userAgent := fmt.Sprintf("%s/%s", DefaultUserAgent, Version)
 	if UserAgentAddition != "" {
 		userAgent = fmt.Sprintf("%s %s", userAgent, strings.TrimSpace(UserAgentAddition))
@@ -186,12 +252,27 @@ func (c *defaultWebConnection) makePlumWebPOSTRequest(urlPath string, postData i
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", api.String(), bytes.NewReader(pd))
+	req, err := http.NewRequestWithContext(ctx, "POST", api.String(), bytes.NewReader(pd))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", userAgent)
 	req.SetBasicAuth(c.config.Email, c.config.Password)
-	return c.HttpClient.Do(req)
+	return c.do(ctx, req, urlPath, id)
+}
+
+// do sends the request, returning a *RequestError if there's no response. If
+// the request failed because the context was cancelled or its deadline passed,
+// the *RequestError wraps the context's error so callers can check for
+// context.Canceled or context.DeadlineExceeded
+func (c *defaultWebConnection) do(ctx context.Context, req *http.Request, urlPath, id string) (*http.Response, error) {
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, &RequestError{Path: urlPath, ID: id, Err: err}
+	}
+	return resp, nil
 }
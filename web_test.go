@@ -1,11 +1,14 @@
 package libplumraw
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,7 +20,7 @@ func TestGetHouses(t *testing.T) {
 		fmt.Fprintln(w, `["houseid1", "houseid2"]`)
 	})
 	wc := newMockHTTP(hf)
-	hs, err := wc.GetHouses()
+	hs, err := wc.GetHouses(context.Background())
 	assert.NoError(t, err)
 	expect := Houses{"houseid1", "houseid2"}
 	assert.Equal(t, expect, hs)
@@ -27,7 +30,7 @@ func TestGetHouses(t *testing.T) {
 		w.WriteHeader(401)
 	})
 	wc = newMockHTTP(hf)
-	_, err = wc.GetHouses()
+	_, err = wc.GetHouses(context.Background())
 	assert.Error(t, err)
 }
 
@@ -56,7 +59,7 @@ func TestGetHouse(t *testing.T) {
 		fmt.Fprintln(w, respStr)
 	})
 	wc := newMockHTTP(hf)
-	hs, err := wc.GetHouse("sending-houseid1")
+	hs, err := wc.GetHouse(context.Background(), "sending-houseid1")
 	assert.NoError(t, err)
 	assert.Equal(t, expHouse, hs)
 
@@ -65,7 +68,7 @@ func TestGetHouse(t *testing.T) {
 		w.WriteHeader(401)
 	})
 	wc = newMockHTTP(hf)
-	_, err = wc.GetHouse("sending-houseid2")
+	_, err = wc.GetHouse(context.Background(), "sending-houseid2")
 	assert.Error(t, err)
 }
 
@@ -80,7 +83,7 @@ func TestGetScenes(t *testing.T) {
 		fmt.Fprintln(w, `["sceneid1", "sceneid2"]`)
 	})
 	wc := newMockHTTP(hf)
-	sc, err := wc.GetScenes("sending-houseid1")
+	sc, err := wc.GetScenes(context.Background(), "sending-houseid1")
 	assert.NoError(t, err)
 	expect := Scenes{"sceneid1", "sceneid2"}
 	assert.Equal(t, expect, sc)
@@ -90,7 +93,7 @@ func TestGetScenes(t *testing.T) {
 		w.WriteHeader(401)
 	})
 	wc = newMockHTTP(hf)
-	_, err = wc.GetScenes("sending-houseid1")
+	_, err = wc.GetScenes(context.Background(), "sending-houseid1")
 	assert.Error(t, err)
 }
 
@@ -113,7 +116,7 @@ func TestGetScene(t *testing.T) {
 		fmt.Fprintln(w, respStr)
 	})
 	wc := newMockHTTP(hf)
-	sc, err := wc.GetScene("sceneid1")
+	sc, err := wc.GetScene(context.Background(), "sceneid1")
 	assert.NoError(t, err)
 	assert.Equal(t, expScene, sc)
 
@@ -122,7 +125,7 @@ func TestGetScene(t *testing.T) {
 		w.WriteHeader(401)
 	})
 	wc = newMockHTTP(hf)
-	_, err = wc.GetScene("sceneid2")
+	_, err = wc.GetScene(context.Background(), "sceneid2")
 	assert.Error(t, err)
 }
 
@@ -145,7 +148,7 @@ func TestGetRoom(t *testing.T) {
 		fmt.Fprintln(w, respStr)
 	})
 	wc := newMockHTTP(hf)
-	room, err := wc.GetRoom("roomid1")
+	room, err := wc.GetRoom(context.Background(), "roomid1")
 	assert.NoError(t, err)
 	assert.Equal(t, expRoom, room)
 
@@ -154,7 +157,7 @@ func TestGetRoom(t *testing.T) {
 		w.WriteHeader(401)
 	})
 	wc = newMockHTTP(hf)
-	_, err = wc.GetRoom("roomid1")
+	_, err = wc.GetRoom(context.Background(), "roomid1")
 	assert.Error(t, err)
 }
 
@@ -177,7 +180,7 @@ func TestGetLogicalLoad(t *testing.T) {
 		fmt.Fprintln(w, respStr)
 	})
 	wc := newMockHTTP(hf)
-	load, err := wc.GetLogicalLoad("loadid1")
+	load, err := wc.GetLogicalLoad(context.Background(), "loadid1")
 	assert.NoError(t, err)
 	assert.Equal(t, expLoad, load)
 
@@ -186,7 +189,7 @@ func TestGetLogicalLoad(t *testing.T) {
 		w.WriteHeader(401)
 	})
 	wc = newMockHTTP(hf)
-	_, err = wc.GetLogicalLoad("loadid1")
+	_, err = wc.GetLogicalLoad(context.Background(), "loadid1")
 	assert.Error(t, err)
 }
 
@@ -240,7 +243,7 @@ func TestGetLightpad(t *testing.T) {
 		fmt.Fprintln(w, respStr)
 	})
 	wc := newMockHTTP(hf)
-	_, err := wc.GetLightpad("pad-id")
+	_, err := wc.GetLightpad(context.Background(), "pad-id")
 	assert.NoError(t, err)
 	// assert.Equal(t, expHouse, pad)
 
@@ -249,10 +252,209 @@ func TestGetLightpad(t *testing.T) {
 		w.WriteHeader(401)
 	})
 	wc = newMockHTTP(hf)
-	_, err = wc.GetLightpad("pad-id")
+	_, err = wc.GetLightpad(context.Background(), "pad-id")
 	assert.Error(t, err)
 }
 
+func TestCreateScene(t *testing.T) {
+	// what I expect to send
+	expCallStr := `{"hid":"houseid1","scene_name":"pastoral","settings":[{"llid":"load-id1","level":70,"fade":10000}]}`
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/v2/createScene", r.URL.Path)
+		bod, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, expCallStr, string(bod))
+		fmt.Fprintln(w, `{"sid":"sceneid1"}`)
+	})
+	wc := newMockHTTP(hf)
+	scene := Scene{
+		Settings: []SceneSettings{{"load-id1", 70, 10000}},
+		HouseID:  "houseid1",
+		Name:     "pastoral",
+	}
+	sc, err := wc.CreateScene(context.Background(), scene)
+	assert.NoError(t, err)
+	scene.ID = "sceneid1"
+	assert.Equal(t, scene, sc)
+
+	// permission denied
+	hf = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+	})
+	wc = newMockHTTP(hf)
+	_, err = wc.CreateScene(context.Background(), scene)
+	assert.Error(t, err)
+}
+
+func TestUpdateScene(t *testing.T) {
+	// what I expect to send
+	expCallStr := `{"sid":"sceneid1","settings":[{"llid":"load-id1","level":0,"fade":500}],"hid":"houseid1","scene_name":"dark"}`
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/v2/updateScene", r.URL.Path)
+		bod, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, expCallStr, string(bod))
+		w.WriteHeader(204)
+	})
+	wc := newMockHTTP(hf)
+	scene := Scene{
+		ID:       "sceneid1",
+		Settings: []SceneSettings{{"load-id1", 0, 500}},
+		HouseID:  "houseid1",
+		Name:     "dark",
+	}
+	err := wc.UpdateScene(context.Background(), scene)
+	assert.NoError(t, err)
+
+	// no such scene
+	hf = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	})
+	wc = newMockHTTP(hf)
+	err = wc.UpdateScene(context.Background(), scene)
+	assert.Error(t, err)
+}
+
+func TestDeleteScene(t *testing.T) {
+	// what I expect to send
+	expCallStr := `{"sid":"sceneid1"}`
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/v2/deleteScene", r.URL.Path)
+		bod, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, expCallStr, string(bod))
+		w.WriteHeader(200)
+	})
+	wc := newMockHTTP(hf)
+	err := wc.DeleteScene(context.Background(), "sceneid1")
+	assert.NoError(t, err)
+
+	// permission denied
+	hf = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+	})
+	wc = newMockHTTP(hf)
+	err = wc.DeleteScene(context.Background(), "sceneid1")
+	assert.Error(t, err)
+}
+
+func TestRename(t *testing.T) {
+	tests := []struct {
+		path    string
+		expCall string
+		rename  func(WebConnection) error
+	}{
+		{
+			"/v2/renameRoom",
+			`{"rid":"roomid1","room_name":"parlor"}`,
+			func(wc WebConnection) error {
+				return wc.RenameRoom(context.Background(), "roomid1", "parlor")
+			},
+		},
+		{
+			"/v2/renameLogicalLoad",
+			`{"llid":"loadid1","logical_load_name":"sconces"}`,
+			func(wc WebConnection) error {
+				return wc.RenameLogicalLoad(context.Background(), "loadid1", "sconces")
+			},
+		},
+		{
+			"/v2/renameLightpad",
+			`{"lpid":"padid1","lightpad_name":"by the door"}`,
+			func(wc WebConnection) error {
+				return wc.RenameLightpad(context.Background(), "padid1", "by the door")
+			},
+		},
+	}
+	for _, tt := range tests {
+		hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "POST", r.Method)
+			assert.Equal(t, tt.path, r.URL.Path)
+			bod, _ := ioutil.ReadAll(r.Body)
+			assert.Equal(t, tt.expCall, string(bod))
+			w.WriteHeader(204)
+		})
+		assert.NoError(t, tt.rename(newMockHTTP(hf)), tt.path)
+
+		// permission denied
+		hf = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(401)
+		})
+		assert.Error(t, tt.rename(newMockHTTP(hf)), tt.path)
+	}
+}
+
+func TestWebErrors(t *testing.T) {
+	tests := []struct {
+		status   int
+		body     string
+		sentinel error
+	}{
+		{401, "bad password", ErrUnauthorized},
+		{404, "no such room", ErrNotFound},
+		{429, "slow down", ErrThrottled},
+		{503, "down for maintenance", ErrServer},
+	}
+	for _, tt := range tests {
+		hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			fmt.Fprintln(w, tt.body)
+		})
+		wc := newMockHTTP(hf)
+		_, err := wc.GetRoom(context.Background(), "roomid1")
+		assert.True(t, errors.Is(err, tt.sentinel), "status %d", tt.status)
+		se := &StatusError{}
+		if assert.True(t, errors.As(err, &se)) {
+			assert.Equal(t, tt.status, se.StatusCode)
+			assert.Equal(t, "/v2/getRoom", se.Path)
+			assert.Equal(t, "roomid1", se.ID)
+			assert.Equal(t, tt.body, se.Body)
+		}
+	}
+
+	// a body that isn't JSON
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `<html>oops</html>`)
+	})
+	wc := newMockHTTP(hf)
+	_, err := wc.GetLogicalLoad(context.Background(), "loadid1")
+	assert.True(t, errors.Is(err, ErrMalformedResponse))
+	de := &DecodeError{}
+	if assert.True(t, errors.As(err, &de)) {
+		assert.Equal(t, "loadid1", de.ID)
+		assert.Equal(t, "<html>oops</html>\n", de.Body)
+	}
+	assert.False(t, errors.Is(err, ErrNotFound))
+}
+
+func TestWebConnectionCancel(t *testing.T) {
+	// the server hangs until the test is over so only the context can end
+	// the request
+	done := make(chan struct{})
+	defer close(done)
+	hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	})
+	wc := newMockHTTP(hf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := wc.GetHouse(ctx, "houseid1")
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = wc.GetHouses(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, errors.Is(err, ErrTimeout))
+}
+
 func newMockHTTP(handler http.Handler) WebConnection {
 	ts := httptest.NewServer(handler)
 	conf := WebConnectionConfig{